@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// redactedHeaders are never written to artifacts
+var redactedHeaders = []string{"Authorization", "Cookie", "X-Api-Key"}
+
+// artifactWriter saves the request sent to Sysdig for each repository and
+// the response it got, as <repo>.request.json and <repo>.response.json, see
+// artifactName.
+// byStatus puts them in a subdirectory named after the outcome, such as
+// failed/.
+type artifactWriter struct {
+	dir      string
+	byStatus bool
+}
+
+func newArtifactWriter(dir string, byStatus bool) (*artifactWriter, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &artifactWriter{dir: dir, byStatus: byStatus}, nil
+}
+
+// save writes the artifacts of one repository, whose result had the given
+// action
+func (w *artifactWriter) save(repo, action string, ex Exchange) error {
+	dir := w.dir
+	if w.byStatus {
+		dir = filepath.Join(w.dir, action)
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	header := ex.Header.Clone()
+	for _, name := range redactedHeaders {
+		if header.Get(name) != "" {
+			header.Set(name, "REDACTED")
+		}
+	}
+
+	request := struct {
+		Method string          `json:"method"`
+		URL    string          `json:"url"`
+		Header http.Header     `json:"headers"`
+		Body   json.RawMessage `json:"body,omitempty"`
+	}{ex.Method, ex.URL, header, rawJSON(ex.Payload)}
+
+	response := struct {
+		Status    int             `json:"status"`
+		RequestID string          `json:"requestId,omitempty"`
+		Body      json.RawMessage `json:"body,omitempty"`
+		Error     string          `json:"error,omitempty"`
+	}{Status: ex.Status, RequestID: ex.SysdigRequestID, Body: rawJSON(ex.Body)}
+	if ex.Err != nil {
+		response.Error = ex.Err.Error()
+	}
+
+	err := writeJSON(filepath.Join(dir, repo+".request.json"), request)
+	if err != nil {
+		return err
+	}
+	return writeJSON(filepath.Join(dir, repo+".response.json"), response)
+}
+
+// artifactName returns the name a repository's artifacts are saved under. A
+// repository whose source name got its owner appended, as disambiguateNames
+// does for repositories of several owners sharing a name, gets it as well.
+func artifactName(repo Repository, name string) string {
+	if name != sourceName(repo.Name) {
+		return repo.Name + "_" + repo.Owner.Login
+	}
+	return repo.Name
+}
+
+// rawJSON embeds a body as is when it is JSON, and as a string otherwise
+func rawJSON(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	} else if json.Valid(body) {
+		return body
+	}
+	quoted, _ := json.Marshal(string(body))
+	return quoted
+}
+
+func writeJSON(filename string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
@@ -0,0 +1,73 @@
+package main
+
+import "sync"
+
+// workerLimit bounds how many repositories are processed at once. An
+// adaptive limit, see -concurrency-auto, moves between min and max: it starts
+// at min, grows by one after as many successes in a row as the current
+// limit, and halves whenever a rate limit signal was seen.
+type workerLimit struct {
+	min, max int
+	// throttled, for adaptive limits, reports whether a rate limit signal
+	// was seen since it was last called
+	throttled func() bool
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	inFlight int
+	streak   int
+}
+
+// newWorkerLimit returns a fixed limit of n repositories at once
+func newWorkerLimit(n int) *workerLimit {
+	l := &workerLimit{min: n, max: n, limit: n}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// newAdaptiveLimit returns a limit adjusted between min and max on the
+// outcome of each repository and the rate limit signals
+func newAdaptiveLimit(min, max int, throttled func() bool) *workerLimit {
+	l := newWorkerLimit(min)
+	l.max = max
+	l.throttled = throttled
+	return l
+}
+
+// acquire blocks until another repository may start
+func (l *workerLimit) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.inFlight >= l.limit {
+		l.cond.Wait()
+	}
+	l.inFlight++
+}
+
+// release ends a repository, adjusting an adaptive limit on its outcome
+func (l *workerLimit) release(succeeded bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	if l.throttled != nil && l.throttled() {
+		l.limit = max(l.min, l.limit/2)
+		l.streak = 0
+	} else if l.throttled != nil && succeeded {
+		l.streak++
+		if l.streak >= l.limit && l.limit < l.max {
+			l.limit++
+			l.streak = 0
+		}
+	} else {
+		l.streak = 0
+	}
+	l.cond.Broadcast()
+}
+
+// current returns the limit in effect
+func (l *workerLimit) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestAdaptiveLimit(t *testing.T) {
+	throttled := false
+	limit := newAdaptiveLimit(1, 4, func() bool { return throttled })
+
+	// Ramps up by one after as many successes as the current limit
+	var limits []int
+	for i := 0; i < 12; i++ {
+		limit.acquire()
+		limit.release(true)
+		limits = append(limits, limit.current())
+	}
+	want := []int{2, 2, 3, 3, 3, 4, 4, 4, 4, 4, 4, 4}
+	for i := range want {
+		if limits[i] != want[i] {
+			t.Fatalf("limits = %v, want %v", limits, want)
+		}
+	}
+
+	// Halves on a rate limit signal, down to min
+	throttled = true
+	for _, want := range []int{2, 1, 1} {
+		limit.acquire()
+		limit.release(true)
+		if got := limit.current(); got != want {
+			t.Errorf("limit after a throttle = %d, want %d", got, want)
+		}
+	}
+
+	// A failure restarts the streak
+	throttled = false
+	limit.acquire()
+	limit.release(false)
+	if got := limit.current(); got != 1 {
+		t.Errorf("limit after a failure = %d, want 1", got)
+	}
+}
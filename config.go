@@ -0,0 +1,665 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultConfig holds the built-in defaults that the config files are
+// layered over
+//
+//go:embed defaults.yaml
+var defaultConfig []byte
+
+// Config struct to match the config.yaml file
+type Config struct {
+	Config struct {
+		SecureURL          string `yaml:"secure_url" json:"secure_url"`
+		SecureAPIToken     string `yaml:"secure_api_token" json:"secure_api_token"`
+		SecureAPITokenFile string `yaml:"secureApiTokenFile" json:"secureApiTokenFile"`
+		CACertFile         string `yaml:"caCertFile" json:"caCertFile"`
+		ClientCertFile     string `yaml:"clientCertFile" json:"clientCertFile"`
+		InsecureSkipVerify bool   `yaml:"insecureSkipVerify" json:"insecureSkipVerify"`
+		// NoTLSSessionCache is only set by the hidden -no-tls-session-cache
+		NoTLSSessionCache         bool                  `yaml:"-" json:"-"`
+		ClientKeyFile             string                `yaml:"clientKeyFile" json:"clientKeyFile"`
+		Auth                      SysdigAuth            `yaml:"auth" json:"auth"`
+		GithubToken               string                `yaml:"github_token" json:"github_token"`
+		GithubTokenFile           string                `yaml:"githubTokenFile" json:"githubTokenFile"`
+		GithubAPIURL              string                `yaml:"githubApiUrl" json:"githubApiUrl"`
+		AccountType               string                `yaml:"accountType" json:"accountType"`
+		AccountName               string                `yaml:"accountName" json:"accountName"`
+		Affiliation               string                `yaml:"affiliation" json:"affiliation"`
+		Orgs                      []string              `yaml:"orgs" json:"orgs"`
+		OrgsFile                  string                `yaml:"orgsFile" json:"orgsFile"`
+		AllowOwners               []string              `yaml:"allowOwners" json:"allowOwners"`
+		DenyOwners                []string              `yaml:"denyOwners" json:"denyOwners"`
+		Team                      string                `yaml:"team" json:"team"`
+		CSVFile                   string                `yaml:"csvFile" json:"csvFile"`
+		RepoSelectorPlugin        string                `yaml:"repoSelectorPlugin" json:"repoSelectorPlugin"`
+		ExcludeTeam               string                `yaml:"excludeTeam" json:"excludeTeam"`
+		DescriptionExcludePattern string                `yaml:"descriptionExcludePattern" json:"descriptionExcludePattern"`
+		IncludeDisabled           bool                  `yaml:"includeDisabled" json:"includeDisabled"`
+		IncludeArchived           bool                  `yaml:"includeArchived" json:"includeArchived"`
+		IncludeTemplates          bool                  `yaml:"includeTemplates" json:"includeTemplates"`
+		MinStars                  int                   `yaml:"minStars" json:"minStars"`
+		RequireWriteAccess        bool                  `yaml:"requireWriteAccess" json:"requireWriteAccess"`
+		Visibility                string                `yaml:"visibility" json:"visibility"`
+		ExcludeForksOf            []string              `yaml:"excludeForksOf" json:"excludeForksOf"`
+		IntegrationID             string                `yaml:"integrationId" json:"integrationId"`
+		PRScanBranchPattern       string                `yaml:"prScanBranchPattern" json:"prScanBranchPattern"`
+		BranchPatternFallback     string                `yaml:"branchPatternFallback" json:"branchPatternFallback"`
+		Folders                   []string              `yaml:"folders" json:"folders"`
+		ValidateFolders           string                `yaml:"validateFolders" json:"validateFolders"`
+		SkipIfNoFolders           bool                  `yaml:"skipIfNoFolders" json:"skipIfNoFolders"`
+		RollbackOnVerifyFailure   bool                  `yaml:"rollbackOnVerifyFailure" json:"rollbackOnVerifyFailure"`
+		ScanTriggers              []string              `yaml:"scanTriggers" json:"scanTriggers"`
+		ScanSchedule              string                `yaml:"scanSchedule" json:"scanSchedule"`
+		Labels                    map[string]string     `yaml:"labels" json:"labels"`
+		CILabels                  map[string][]string   `yaml:"ciLabels" json:"ciLabels"`
+		RepoConfig                map[string]RepoConfig `yaml:"repoConfig" json:"repoConfig"`
+		Idempotent                bool                  `yaml:"idempotent" json:"idempotent"`
+		StrictIdempotency         bool                  `yaml:"strictIdempotency" json:"strictIdempotency"`
+		DisambiguateNames         bool                  `yaml:"disambiguateNames" json:"disambiguateNames"`
+		TimeoutSeconds            int                   `yaml:"timeoutSeconds" json:"timeoutSeconds"`
+		WebhookURL                string                `yaml:"webhookUrl" json:"webhookUrl"`
+		SMTPHost                  string                `yaml:"smtpHost" json:"smtpHost"`
+		SMTPPort                  int                   `yaml:"smtpPort" json:"smtpPort"`
+		SMTPFrom                  string                `yaml:"smtpFrom" json:"smtpFrom"`
+		SMTPTo                    []string              `yaml:"smtpTo" json:"smtpTo"`
+		GithubConcurrency         int                   `yaml:"githubConcurrency" json:"githubConcurrency"`
+		GithubPageTimeoutSeconds  int                   `yaml:"githubPageTimeoutSeconds" json:"githubPageTimeoutSeconds"`
+		GithubRetryStatuses       []int                 `yaml:"githubRetryStatuses" json:"githubRetryStatuses"`
+		GithubRateLimitThreshold  int                   `yaml:"githubRateLimitThreshold" json:"githubRateLimitThreshold"`
+		SysdigConcurrency         int                   `yaml:"sysdigConcurrency" json:"sysdigConcurrency"`
+		ConcurrencyAutoMin        int                   `yaml:"concurrencyAutoMin" json:"concurrencyAutoMin"`
+		ConcurrencyAutoMax        int                   `yaml:"concurrencyAutoMax" json:"concurrencyAutoMax"`
+		SysdigRateLimitCooldown   int                   `yaml:"sysdigRateLimitCooldownSeconds" json:"sysdigRateLimitCooldownSeconds"`
+		RequestDelayMs            int                   `yaml:"requestDelayMs" json:"requestDelayMs"`
+		GithubRequestDelayMs      int                   `yaml:"githubRequestDelayMs" json:"githubRequestDelayMs"`
+		MaxRepos                  int                   `yaml:"maxRepos" json:"maxRepos"`
+		MaxResponseBytes          int64                 `yaml:"maxResponseBytes" json:"maxResponseBytes"`
+		MessageFormat             MessageFormat         `yaml:"messageFormat" json:"messageFormat"`
+		SortOrder                 string                `yaml:"sortOrder" json:"sortOrder"`
+		PayloadFieldMap           map[string]string     `yaml:"payloadFieldMap" json:"payloadFieldMap"`
+		WrapInSource              *bool                 `yaml:"wrapInSource" json:"wrapInSource"`
+		StateFile                 string                `yaml:"stateFile" json:"stateFile"`
+	} `yaml:"config" json:"config"`
+}
+
+// SysdigAuth holds the OAuth client credentials Sysdig access tokens are
+// fetched with, in place of a static secure_api_token
+type SysdigAuth struct {
+	ClientID     string `yaml:"clientId" json:"clientId"`
+	ClientSecret string `yaml:"clientSecret" json:"clientSecret"`
+	TokenURL     string `yaml:"tokenUrl" json:"tokenUrl"`
+}
+
+// RepoConfig overrides settings for the repositories whose name matches its
+// key in the repoConfig map. Keys are exact names or glob patterns.
+type RepoConfig struct {
+	Labels              map[string]string `yaml:"labels" json:"labels"`
+	ScanSchedule        string            `yaml:"scanSchedule" json:"scanSchedule"`
+	ScanTriggers        []string          `yaml:"scanTriggers" json:"scanTriggers"`
+	Folders             []string          `yaml:"folders" json:"folders"`
+	PRScanBranchPattern string            `yaml:"prScanBranchPattern" json:"prScanBranchPattern"`
+	IntegrationID       string            `yaml:"integrationId" json:"integrationId"`
+}
+
+// LoadConfig reads and parses the YAML or JSON configuration files, "-" being
+// stdin. Later files are merged over earlier ones: non-empty values override,
+// maps are merged key by key and lists such as folders are replaced as a whole.
+// The built-in defaults fill what is left empty, then the "path=value" sets
+// are applied, see (*Config).set.
+func LoadConfig(filenames []string, sets ...string) (*Config, error) {
+	var config Config
+	for _, filename := range filenames {
+		var data []byte
+		var err error
+		if filename == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else if isConfigURL(filename) {
+			data, err = fetchConfig(filename)
+		} else {
+			data, err = ioutil.ReadFile(filename)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		layer, err := parseConfig(configPath(filename), data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		mergeValues(reflect.ValueOf(&config).Elem(), reflect.ValueOf(layer))
+	}
+
+	// Sets come after the defaults, so they can empty a defaulted setting
+	err := config.applyDefaults()
+	if err != nil {
+		return nil, err
+	}
+	for _, assignment := range sets {
+		err := config.set(assignment)
+		if err != nil {
+			return nil, fmt.Errorf("-set %s: %v", assignment, err)
+		}
+	}
+
+	// The rows of the CSV file override the settings of their repository
+	if config.Config.CSVFile != "" {
+		_, overrides, err := readCSVFile(config.Config.CSVFile, config.Config.AccountName)
+		if err != nil {
+			return nil, fmt.Errorf("csvFile: %v", err)
+		}
+		if config.Config.RepoConfig == nil {
+			config.Config.RepoConfig = make(map[string]RepoConfig)
+		}
+		for name, override := range overrides {
+			merged := config.Config.RepoConfig[name]
+			mergeValues(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(override))
+			config.Config.RepoConfig[name] = merged
+		}
+	}
+
+	// Organizations listed in a file are added to orgs
+	if config.Config.OrgsFile != "" {
+		orgs, err := readOrgsFile(config.Config.OrgsFile)
+		if err != nil {
+			return nil, fmt.Errorf("orgsFile: %v", err)
+		}
+		config.Config.Orgs = append(config.Config.Orgs, orgs...)
+	}
+
+	// Tokens read from files take precedence over the inline values
+	if config.Config.GithubTokenFile != "" {
+		config.Config.GithubToken, err = readTokenFile(config.Config.GithubTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("githubTokenFile: %v", err)
+		}
+	}
+	if config.Config.SecureAPITokenFile != "" {
+		config.Config.SecureAPIToken, err = readTokenFile(config.Config.SecureAPITokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("secureApiTokenFile: %v", err)
+		}
+	}
+
+	return &config, nil
+}
+
+// applyDefaults sets the settings left empty to the built-in defaults.
+// Booleans have no defaults, since false can't be told apart from unset
+func (c *Config) applyDefaults() error {
+	var defaults Config
+	err := yaml.Unmarshal(defaultConfig, &defaults)
+	if err != nil {
+		return fmt.Errorf("built-in defaults: %v", err)
+	}
+	mergeValues(reflect.ValueOf(&defaults).Elem(), reflect.ValueOf(*c))
+	*c = defaults
+	return nil
+}
+
+// set overrides the setting at a dotted path, such as "labels.team=platform".
+// The value is decoded as YAML into the setting's type; strings are taken as
+// is and lists may be comma-separated. Unlike merged files, a set can turn a
+// setting off or empty it.
+func (c *Config) set(assignment string) error {
+	name, value, found := strings.Cut(assignment, "=")
+	if !found || name == "" {
+		return fmt.Errorf("expected path=value")
+	}
+	path := strings.Split(strings.TrimPrefix(name, "config."), ".")
+	return setPath(reflect.ValueOf(&c.Config).Elem(), path, value)
+}
+
+// setPath decodes value into the setting at path below v
+func setPath(v reflect.Value, path []string, value string) error {
+	if len(path) == 0 && v.Kind() == reflect.String {
+		// Taken as is, YAML would reject values such as @daily
+		v.SetString(value)
+		return nil
+	} else if len(path) == 0 {
+		if v.Kind() == reflect.Slice && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			value = "[" + value + "]"
+		}
+		decoded := reflect.New(v.Type())
+		err := yaml.UnmarshalStrict([]byte(value), decoded.Interface())
+		if err != nil {
+			return fmt.Errorf("invalid value: %v", err)
+		}
+		v.Set(decoded.Elem())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			tag := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+			if tag == path[0] && tag != "-" {
+				return setPath(v.Field(i), path[1:], value)
+			}
+		}
+		return fmt.Errorf("unknown setting %q", path[0])
+	case reflect.Map:
+		// Map entries can't be changed in place, so a copy is set back
+		key := reflect.ValueOf(path[0])
+		entry := reflect.New(v.Type().Elem()).Elem()
+		if !v.IsNil() && v.MapIndex(key).IsValid() {
+			entry.Set(v.MapIndex(key))
+		}
+		err := setPath(entry, path[1:], value)
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(key, entry)
+		return nil
+	}
+	return fmt.Errorf("%q has no setting %q", v.Type(), path[0])
+}
+
+// parseConfig decodes a configuration by its file extension. Other files,
+// such as stdin, are tried as YAML and then as JSON.
+func parseConfig(filename string, data []byte) (Config, error) {
+	var config Config
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return config, json.Unmarshal(data, &config)
+	case ".yaml", ".yml":
+		return config, strictYAML(data, &config)
+	}
+
+	err := strictYAML(data, &config)
+	if err != nil {
+		config = Config{}
+		if json.Unmarshal(data, &config) == nil {
+			return config, nil
+		}
+	}
+	return config, err
+}
+
+// configURLAuthEnv names the environment variable whose value, when set, is
+// sent as the Authorization header of remote config requests
+const configURLAuthEnv = "GITSOURCES_CONFIG_AUTH"
+
+// isConfigURL tells whether a -config argument is a remote URL
+func isConfigURL(filename string) bool {
+	return strings.HasPrefix(filename, "https://") || strings.HasPrefix(filename, "http://")
+}
+
+// configPath returns the path parseConfig goes by, the URL path of remote
+// configs so that a query string doesn't hide their extension
+func configPath(filename string) string {
+	if u, err := url.Parse(filename); err == nil && isConfigURL(filename) {
+		return u.Path
+	}
+	return filename
+}
+
+// fetchConfig downloads a remote config. It is read before any setting is
+// known, so the default maxResponseBytes applies.
+func fetchConfig(configURL string) ([]byte, error) {
+	req, err := http.NewRequest("GET", configURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if auth := os.Getenv(configURLAuthEnv); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := readBody(resp.Body, defaultMaxResponseBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", configURL, err)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: answered %s", configURL, resp.Status)
+	}
+	return data, nil
+}
+
+// strictYAML decodes YAML, rejecting the unknown and duplicate keys yaml.v2
+// would otherwise ignore, such as a misspelt "foldres" or a pasted "folders"
+// overriding the first. Errors name the key and its line.
+func strictYAML(data []byte, v interface{}) error {
+	err := yaml.UnmarshalStrict(data, v)
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return err
+	}
+
+	problems := make([]string, len(typeErr.Errors))
+	for i, problem := range typeErr.Errors {
+		if m := unknownKeyError.FindStringSubmatch(problem); m != nil {
+			problem = fmt.Sprintf("%s unknown setting %q", m[1], m[2])
+		} else if m := duplicateKeyError.FindStringSubmatch(problem); m != nil {
+			problem = fmt.Sprintf("%s duplicate setting %q", m[1], m[2])
+		}
+		problems[i] = problem
+	}
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+// The messages of yaml.UnmarshalStrict, which strictYAML rewords
+var (
+	unknownKeyError   = regexp.MustCompile(`^(line \d+:) field (\S+) not found in type `)
+	duplicateKeyError = regexp.MustCompile(`^(line \d+:) (?:field|key) "?([^"\s]+)"? already set in `)
+)
+
+// Validate checks that the required settings are present and that the
+// settings restricted to a few values hold one of them
+func (c *Config) Validate() error {
+	// OAuth client credentials replace the API token, and take all three
+	// settings
+	auth := c.Config.Auth
+	token, tokenSetting := c.Config.SecureAPIToken, "secure_api_token"
+	if auth.ClientID != "" || auth.ClientSecret != "" || auth.TokenURL != "" {
+		token, tokenSetting = "", "auth.clientId, auth.clientSecret and auth.tokenUrl"
+		if auth.ClientID != "" && auth.ClientSecret != "" && auth.TokenURL != "" {
+			token = auth.ClientID
+		}
+	}
+
+	var missing []string
+	required := []struct {
+		name  string
+		value string
+	}{
+		{"secure_url", c.Config.SecureURL},
+		{tokenSetting, token},
+		{"github_token", c.Config.GithubToken},
+		{"accountType", c.Config.AccountType},
+		{"integrationId", c.Config.IntegrationID},
+	}
+	for _, field := range required {
+		if field.value == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	if c.Config.AccountType == "org" && c.Config.AccountName == "" {
+		missing = append(missing, "accountName")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+
+	if c.Config.AccountType != "org" && c.Config.AccountType != "user" && c.Config.AccountType != "all-orgs" {
+		return fmt.Errorf("invalid accountType %q: must be 'user', 'org' or 'all-orgs'", c.Config.AccountType)
+	} else if c.Config.AccountType == "all-orgs" && (c.Config.Team != "" || c.Config.ExcludeTeam != "") {
+		return fmt.Errorf("team and excludeTeam cannot be used with accountType 'all-orgs', team slugs belong to a single organization")
+	}
+
+	if c.Config.Affiliation != "" && c.Config.AccountType != "user" {
+		return fmt.Errorf("affiliation requires accountType 'user'")
+	}
+	for _, affiliation := range strings.Split(c.Config.Affiliation, ",") {
+		switch strings.TrimSpace(affiliation) {
+		case "", "owner", "collaborator", "organization_member":
+		default:
+			return fmt.Errorf("invalid affiliation %q: must be a comma-separated list of 'owner', 'collaborator' and 'organization_member'", affiliation)
+		}
+	}
+
+	if len(c.Config.Orgs) > 0 && c.Config.AccountType != "org" {
+		return fmt.Errorf("orgs requires accountType 'org'")
+	} else if len(c.Config.Orgs) > 0 && c.Config.Team != "" {
+		return fmt.Errorf("team cannot be used with orgs, team slugs belong to a single organization")
+	}
+
+	if _, err := parseMessageFormat(c.Config.MessageFormat); err != nil {
+		return err
+	}
+
+	if _, err := regexp.Compile(c.Config.DescriptionExcludePattern); err != nil {
+		return fmt.Errorf("invalid descriptionExcludePattern: %v", err)
+	}
+
+	if err := validateSchedule(c.Config.ScanSchedule); err != nil {
+		return fmt.Errorf("invalid scanSchedule: %v", err)
+	}
+	if err := validateTriggers(c.Config.ScanTriggers); err != nil {
+		return fmt.Errorf("invalid scanTriggers: %v", err)
+	}
+	for key, override := range c.Config.RepoConfig {
+		if err := validateSchedule(override.ScanSchedule); err != nil {
+			return fmt.Errorf("invalid scanSchedule for repoConfig %q: %v", key, err)
+		}
+		if err := validateTriggers(override.ScanTriggers); err != nil {
+			return fmt.Errorf("invalid scanTriggers for repoConfig %q: %v", key, err)
+		}
+	}
+
+	switch c.Config.SortOrder {
+	case "", "name-asc", "name-desc", "updated-desc":
+	default:
+		return fmt.Errorf("invalid sortOrder %q: must be 'name-asc', 'name-desc' or 'updated-desc'", c.Config.SortOrder)
+	}
+
+	switch c.Config.Visibility {
+	case "", "all", "public", "private", "internal":
+	default:
+		return fmt.Errorf("invalid visibility %q: must be 'all', 'public', 'private' or 'internal'", c.Config.Visibility)
+	}
+
+	switch c.Config.ValidateFolders {
+	case "", "warn", "skip":
+	default:
+		return fmt.Errorf("invalid validateFolders %q: must be 'warn' or 'skip'", c.Config.ValidateFolders)
+	}
+
+	switch c.Config.BranchPatternFallback {
+	case "", "default-branch", "literal":
+	default:
+		return fmt.Errorf("invalid branchPatternFallback %q: must be 'default-branch' or 'literal'", c.Config.BranchPatternFallback)
+	}
+
+	if c.Config.CSVFile != "" && c.Config.RepoSelectorPlugin != "" {
+		return fmt.Errorf("csvFile and repoSelectorPlugin cannot be combined")
+	}
+
+	for _, status := range c.Config.GithubRetryStatuses {
+		if status < 400 || status > 599 {
+			return fmt.Errorf("invalid githubRetryStatuses entry %d: must be an HTTP error status (400-599)", status)
+		}
+	}
+
+	// Two fields sent under the same key would overwrite each other
+	keys := make(map[string]string)
+	for field, key := range c.Config.PayloadFieldMap {
+		if !payloadFields[field] {
+			return fmt.Errorf("invalid payloadFieldMap field %q: must be repository, folders, prScanBranchPattern, integrationId, name, labels, scanSchedule or scanTriggers", field)
+		} else if key == "" {
+			return fmt.Errorf("invalid payloadFieldMap: %s is mapped to an empty key", field)
+		} else if other, found := keys[key]; found {
+			return fmt.Errorf("invalid payloadFieldMap: %s and %s are both mapped to %q", other, field, key)
+		}
+		keys[key] = field
+	}
+
+	return nil
+}
+
+// payloadFields are the fields of a source payload payloadFieldMap can rename
+var payloadFields = map[string]bool{
+	"repository": true, "folders": true, "prScanBranchPattern": true, "integrationId": true,
+	"name": true, "labels": true, "scanSchedule": true, "scanTriggers": true,
+}
+
+// cronField matches a single field of a cron expression, such as "*/15",
+// "1-5" or "mon,wed"
+var cronField = regexp.MustCompile(`^[0-9A-Za-z*/,-]+$`)
+
+// validateSchedule checks that a scan schedule is empty, a 5-field cron
+// expression or one of the @hourly style shorthands
+func validateSchedule(schedule string) error {
+	switch schedule {
+	case "", "@hourly", "@daily", "@weekly", "@monthly", "@yearly", "@annually":
+		return nil
+	}
+
+	fields := strings.Fields(schedule)
+	if len(fields) != 5 {
+		return fmt.Errorf("%q must be a 5-field cron expression or @hourly, @daily, @weekly, @monthly or @yearly", schedule)
+	}
+	for _, field := range fields {
+		if !cronField.MatchString(field) {
+			return fmt.Errorf("%q has an invalid field %q", schedule, field)
+		}
+	}
+	return nil
+}
+
+// validateTriggers checks that every scan trigger is push, pullRequest or
+// schedule
+func validateTriggers(triggers []string) error {
+	for _, trigger := range triggers {
+		switch trigger {
+		case "push", "pullRequest", "schedule":
+		default:
+			return fmt.Errorf("%q must be 'push', 'pullRequest' or 'schedule'", trigger)
+		}
+	}
+	return nil
+}
+
+// githubAPIURL returns the GitHub API base URL without a trailing slash
+func (c *Config) githubAPIURL() string {
+	url := strings.TrimRight(c.Config.GithubAPIURL, "/")
+	if url == "" {
+		url = "https://api.github.com"
+	}
+	return url
+}
+
+// sysdigAPIURL returns the base URL of the Sysdig git provider API
+func (c *Config) sysdigAPIURL() string {
+	return strings.TrimRight(c.Config.SecureURL, "/") + "/api/cspm/v1/gitProvider"
+}
+
+// wrapInSource reports whether source payloads go under a source key, which
+// they do unless wrapInSource is set to false
+func (c *Config) wrapInSource() bool {
+	return c.Config.WrapInSource == nil || *c.Config.WrapInSource
+}
+
+// repoConfigs returns the repoConfig entries matching a repository, glob
+// patterns first (in key order) and the exact name last so it wins
+func (c *Config) repoConfigs(repo string) []RepoConfig {
+	var patterns []string
+	for pattern := range c.Config.RepoConfig {
+		if matched, _ := path.Match(pattern, repo); matched && pattern != repo {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+
+	var matches []RepoConfig
+	for _, pattern := range patterns {
+		matches = append(matches, c.Config.RepoConfig[pattern])
+	}
+	if exact, found := c.Config.RepoConfig[repo]; found {
+		matches = append(matches, exact)
+	}
+	return matches
+}
+
+// expandPlaceholders replaces ${repo} and ${owner} with the repository's name
+// and owner, and any other ${VAR} with the environment variable of that name
+func expandPlaceholders(value string, repo Repository) string {
+	return os.Expand(value, func(name string) string {
+		switch name {
+		case "repo":
+			return repo.Name
+		case "owner":
+			return repo.Owner.Login
+		}
+		return os.Getenv(name)
+	})
+}
+
+// mergeValues copies the non-empty fields of src over dst
+func mergeValues(dst, src reflect.Value) {
+	switch src.Kind() {
+	case reflect.Struct:
+		for i := 0; i < src.NumField(); i++ {
+			mergeValues(dst.Field(i), src.Field(i))
+		}
+	case reflect.Map:
+		if src.Len() == 0 {
+			return
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMap(src.Type()))
+		}
+		for _, key := range src.MapKeys() {
+			dst.SetMapIndex(key, src.MapIndex(key))
+		}
+	default:
+		if !src.IsZero() {
+			dst.Set(src)
+		}
+	}
+}
+
+// readOrgsFile returns the organizations listed in a file, either as a YAML
+// list or one per line. Blank lines and # comments are ignored in the latter.
+func readOrgsFile(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read orgs file: %v", err)
+	}
+
+	var orgs []string
+	if yaml.Unmarshal(data, &orgs) == nil {
+		return orgs, nil
+	}
+
+	orgs = nil
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			orgs = append(orgs, line)
+		}
+	}
+	return orgs, nil
+}
+
+// readTokenFile returns the token stored in a file, such as a mounted secret
+func readTokenFile(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("cannot read token file: %v", err)
+	}
+
+	token := strings.TrimRight(string(data), "\r\n")
+	if strings.TrimSpace(token) == "" {
+		return "", fmt.Errorf("token file %s is empty", filename)
+	}
+
+	return token, nil
+}
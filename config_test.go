@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigAppliesDefaults(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(filename, []byte(`config:
+  accountType: org
+  githubConcurrency: 8
+  folders: ["/infra"]
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig([]string{filename})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	// Settings from the file win over the defaults
+	if config.Config.AccountType != "org" {
+		t.Errorf("accountType = %q", config.Config.AccountType)
+	}
+	if config.Config.GithubConcurrency != 8 {
+		t.Errorf("githubConcurrency = %d, want 8", config.Config.GithubConcurrency)
+	}
+	if !reflect.DeepEqual(config.Config.Folders, []string{"/infra"}) {
+		t.Errorf("folders = %v, want [/infra]", config.Config.Folders)
+	}
+
+	// The others get the defaults
+	if config.Config.SysdigConcurrency != 1 {
+		t.Errorf("sysdigConcurrency = %d, want 1", config.Config.SysdigConcurrency)
+	}
+	if config.Config.SMTPPort != 25 {
+		t.Errorf("smtpPort = %d, want 25", config.Config.SMTPPort)
+	}
+	if config.Config.SortOrder != "name-asc" {
+		t.Errorf("sortOrder = %q, want name-asc", config.Config.SortOrder)
+	}
+	if config.Config.BranchPatternFallback != "default-branch" {
+		t.Errorf("branchPatternFallback = %q, want default-branch", config.Config.BranchPatternFallback)
+	}
+}
+
+func TestApplyDefaultsOnEmptyConfig(t *testing.T) {
+	var config Config
+	if err := config.applyDefaults(); err != nil {
+		t.Fatalf("applyDefaults: %v", err)
+	}
+	if !reflect.DeepEqual(config.Config.Folders, []string{"/"}) {
+		t.Errorf("folders = %v, want [/]", config.Config.Folders)
+	}
+	if config.Config.GithubConcurrency != defaultGitHubConcurrency {
+		t.Errorf("githubConcurrency = %d, want %d", config.Config.GithubConcurrency, defaultGitHubConcurrency)
+	}
+}
+
+func TestConfigSet(t *testing.T) {
+	var config Config
+	config.Config.Idempotent = true
+	for _, assignment := range []string{
+		"accountName=acme",
+		"idempotent=false",
+		"sysdigConcurrency=10",
+		"folders=/,/infra",
+		"labels.team=platform",
+		"repoConfig.api.scanSchedule=@daily",
+		"config.messageFormat.success=OK {{.Repo}}",
+	} {
+		if err := config.set(assignment); err != nil {
+			t.Fatalf("set %s: %v", assignment, err)
+		}
+	}
+
+	c := config.Config
+	if c.AccountName != "acme" || c.Idempotent || c.SysdigConcurrency != 10 {
+		t.Errorf("accountName = %q, idempotent = %v, sysdigConcurrency = %d", c.AccountName, c.Idempotent, c.SysdigConcurrency)
+	}
+	if !reflect.DeepEqual(c.Folders, []string{"/", "/infra"}) {
+		t.Errorf("folders = %v", c.Folders)
+	}
+	if c.Labels["team"] != "platform" || c.RepoConfig["api"].ScanSchedule != "@daily" || c.MessageFormat.Success != "OK {{.Repo}}" {
+		t.Errorf("labels = %v, repoConfig = %v, messageFormat = %+v", c.Labels, c.RepoConfig, c.MessageFormat)
+	}
+
+	for _, assignment := range []string{"concurrency=10", "sysdigConcurrency=many", "accountName"} {
+		if err := config.set(assignment); err == nil {
+			t.Errorf("set %s succeeded", assignment)
+		}
+	}
+}
+
+func TestLoadConfigRejectsUnknownAndDuplicateKeys(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(filename, []byte(`config:
+  accountType: org
+  foldres: ["/"]
+  folders: ["/a"]
+  folders: ["/b"]
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig([]string{filename})
+	want := filename + `: line 3: unknown setting "foldres"; line 5: duplicate setting "folders"`
+	if err == nil || err.Error() != want {
+		t.Errorf("LoadConfig error = %v, want %s", err, want)
+	}
+
+	// The reference documents every setting, so it must load
+	if _, err := LoadConfig([]string{"configref.yaml"}); err != nil {
+		t.Errorf("configref.yaml: %v", err)
+	}
+}
+
+func TestLoadConfigFromURL(t *testing.T) {
+	t.Setenv(configURLAuthEnv, "Bearer config-token")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer config-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("config:\n  accountType: org\n  accountName: acme\n"))
+	}))
+	defer server.Close()
+
+	config, err := LoadConfig([]string{server.URL + "/gitsources.yaml?env=prod"})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if config.Config.AccountName != "acme" || config.Config.GithubConcurrency != 4 {
+		t.Errorf("config = %+v", config.Config)
+	}
+
+	t.Setenv(configURLAuthEnv, "")
+	if _, err := LoadConfig([]string{server.URL + "/gitsources.yaml"}); err == nil {
+		t.Errorf("LoadConfig without authorization succeeded")
+	}
+}
+
+func TestLoadConfigSetEmptiesDefaults(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(filename, []byte("config:\n  accountName: acme\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig([]string{filename}, "branchPatternFallback=", "maxResponseBytes=0", "wrapInSource=false", "labels.team=platform")
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	c := config.Config
+	if c.BranchPatternFallback != "" || c.MaxResponseBytes != 0 || config.wrapInSource() {
+		t.Errorf("branchPatternFallback = %q, maxResponseBytes = %d, wrapInSource = %v", c.BranchPatternFallback, c.MaxResponseBytes, config.wrapInSource())
+	}
+	if c.SortOrder != "name-asc" || c.Labels["team"] != "platform" {
+		t.Errorf("sortOrder = %q, labels = %v", c.SortOrder, c.Labels)
+	}
+}
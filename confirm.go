@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// confirm lists the sources about to be added, updated or removed and asks
+// whether to proceed. Anything but "y" or "yes" declines.
+func confirm(in io.Reader, out io.Writer, repos []string) bool {
+	fmt.Fprintf(out, "%d sources will change:\n", len(repos))
+	for _, repo := range repos {
+		fmt.Fprintf(out, "  %s\n", repo)
+	}
+	fmt.Fprint(out, "Proceed? [y/N] ")
+
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readCSVFile reads the repositories of a csvFile, one
+// "repo,folders,branchPattern,integrationId" row each, and the overrides of
+// their rows by repository name. Repositories without an owner belong to
+// owner. Folders are separated by semicolons and empty cells override nothing.
+// Overrides are keyed by name like repoConfig, so two rows naming the same
+// repository, even of different owners, are an error.
+func readCSVFile(filename, owner string) ([]Repository, map[string]RepoConfig, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	repositories := []Repository{}
+	overrides := make(map[string]RepoConfig)
+	lines := make(map[string]int)
+	for i, row := range rows {
+		cell := func(n int) string {
+			if n < len(row) {
+				return strings.TrimSpace(row[n])
+			}
+			return ""
+		}
+		if i == 0 && strings.EqualFold(cell(0), "repo") {
+			continue
+		}
+		if len(row) > 4 {
+			return nil, nil, fmt.Errorf("line %d: %d columns, expected at most 4", i+1, len(row))
+		} else if cell(0) == "" {
+			return nil, nil, fmt.Errorf("line %d: the repo column is empty", i+1)
+		}
+
+		var repo Repository
+		repo.Owner.Login = owner
+		repo.Name = cell(0)
+		if j := strings.LastIndex(repo.Name, "/"); j >= 0 {
+			repo.Owner.Login = repo.Name[:j]
+			repo.Name = repo.Name[j+1:]
+		}
+		repo.FullName = repo.Owner.Login + "/" + repo.Name
+		if line, found := lines[repo.Name]; found {
+			return nil, nil, fmt.Errorf("line %d: repository %s is already listed on line %d", i+1, repo.Name, line)
+		}
+		lines[repo.Name] = i + 1
+		repositories = append(repositories, repo)
+
+		var override RepoConfig
+		for _, folder := range strings.Split(cell(1), ";") {
+			if folder = strings.TrimSpace(folder); folder != "" {
+				override.Folders = append(override.Folders, folder)
+			}
+		}
+		override.PRScanBranchPattern = cell(2)
+		override.IntegrationID = cell(3)
+		overrides[repo.Name] = override
+	}
+	return repositories, overrides, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadCSVFileRejectsNamesakes(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "repos.csv")
+	err := ioutil.WriteFile(filename, []byte("repo,folders\nacme/api,/\nweb,/app\nwidgets/api,/src\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = readCSVFile(filename, "acme")
+	want := "line 4: repository api is already listed on line 2"
+	if err == nil || err.Error() != want {
+		t.Errorf("readCSVFile error = %v, want %s", err, want)
+	}
+}
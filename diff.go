@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// diffSources describes the fields that differ between two configurations
+// of a source, one line per field, such as
+//
+//	folders: +/k8s -/infra
+//	prScanBranchPattern: "main" → "release/*"
+func diffSources(old, new SourceSpec) []string {
+	var changes []string
+	changed := func(field, from, to string) {
+		if from != to {
+			changes = append(changes, fmt.Sprintf("%s: %q → %q", field, from, to))
+		}
+	}
+
+	changed("repository", old.Repository, new.Repository)
+	if change := diffLists(old.Folders, new.Folders); change != "" {
+		changes = append(changes, "folders: "+change)
+	}
+	changed("prScanBranchPattern", old.PRScanBranchPattern, new.PRScanBranchPattern)
+	changed("integrationId", old.IntegrationID, new.IntegrationID)
+	if change := diffLabels(old.Labels, new.Labels); change != "" {
+		changes = append(changes, "labels: "+change)
+	}
+	changed("scanSchedule", old.ScanSchedule, new.ScanSchedule)
+	if change := diffLists(old.ScanTriggers, new.ScanTriggers); change != "" {
+		changes = append(changes, "scanTriggers: "+change)
+	}
+	return changes
+}
+
+// diffLists returns the added (+) and removed (-) entries of a list, or the
+// whole lists when only their order changed
+func diffLists(old, new []string) string {
+	if strings.Join(old, "\x00") == strings.Join(new, "\x00") {
+		return ""
+	}
+
+	had := make(map[string]bool)
+	for _, entry := range old {
+		had[entry] = true
+	}
+	has := make(map[string]bool)
+	for _, entry := range new {
+		has[entry] = true
+	}
+
+	var parts []string
+	for _, entry := range new {
+		if !had[entry] {
+			parts = append(parts, "+"+entry)
+		}
+	}
+	for _, entry := range old {
+		if !has[entry] {
+			parts = append(parts, "-"+entry)
+		}
+	}
+	if len(parts) == 0 {
+		return fmt.Sprintf("%v → %v", old, new)
+	}
+	return strings.Join(parts, " ")
+}
+
+// diffLabels returns the added (+), removed (-) and changed (~) labels
+func diffLabels(old, new map[string]string) string {
+	keys := make(map[string]bool)
+	for key := range old {
+		keys[key] = true
+	}
+	for key := range new {
+		keys[key] = true
+	}
+	var sorted []string
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var parts []string
+	for _, key := range sorted {
+		before, had := old[key]
+		after, has := new[key]
+		if !had {
+			parts = append(parts, fmt.Sprintf("+%s=%s", key, after))
+		} else if !has {
+			parts = append(parts, fmt.Sprintf("-%s=%s", key, before))
+		} else if before != after {
+			parts = append(parts, fmt.Sprintf("~%s=%s→%s", key, before, after))
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffSources(t *testing.T) {
+	old := SourceSpec{
+		Repository:          "alpha",
+		Folders:             []string{"/", "/infra"},
+		PRScanBranchPattern: "main",
+		IntegrationID:       "integration-1",
+		Labels:              map[string]string{"team": "platform", "env": "prod"},
+	}
+	new := old
+	new.Folders = []string{"/", "/k8s"}
+	new.PRScanBranchPattern = "release/*"
+	new.Labels = map[string]string{"team": "payments", "tier": "1"}
+
+	want := []string{
+		"folders: +/k8s -/infra",
+		`prScanBranchPattern: "main" → "release/*"`,
+		"labels: -env=prod ~team=platform→payments +tier=1",
+	}
+	if got := diffSources(old, new); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffSources = %q, want %q", got, want)
+	}
+	if got := diffSources(old, old); got != nil {
+		t.Errorf("diffSources of equal sources = %q", got)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// doctor runs a checklist of common misconfigurations and prints a pass/fail
+// line with a remediation hint for each. loadErr is the error, if any, from
+// loading the configuration. It returns false if any check failed.
+func doctor(config *Config, loadErr error) bool {
+	ok := true
+	report := func(name string, err error, hint string) {
+		if err == nil {
+			fmt.Printf("[PASS] %s\n", name)
+			return
+		}
+		ok = false
+		fmt.Printf("[FAIL] %s: %v\n       %s\n", name, err, hint)
+	}
+
+	report("configuration parses", loadErr, "check that the file exists and is valid YAML, or JSON for .json files")
+	if loadErr != nil {
+		return false
+	}
+
+	report("required settings are present", config.Validate(), "see configref.yaml for the expected settings")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	report("GitHub token is valid and scoped", checkGitHubToken(ctx, config),
+		"create a token with the repo scope (and read:org when using team, excludeTeam or all-orgs)")
+
+	sysdig, err := NewSysdigClient(config)
+	if err != nil {
+		report("Sysdig TLS settings load", err, "check caCertFile, clientCertFile and clientKeyFile")
+		return false
+	}
+
+	_, err = sysdig.ListSources(ctx)
+	report("Sysdig API is reachable and the token is valid", err,
+		"check that secure_url matches your region and secure_api_token, or the auth client credentials, are current")
+
+	report("Sysdig integration exists", checkIntegration(ctx, sysdig, config),
+		"copy integrationId from the URL of the integration page in Sysdig Secure")
+
+	return ok
+}
+
+// validate is the quick check of -validate-only: it validates the config and
+// makes one request to each API with the credentials, without listing
+// repositories or sources
+func validate(config *Config) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	github := NewGitHubClient(config.githubAPIURL(), config.Config.GithubToken)
+	var user struct{}
+	_, err = github.get(ctx, github.BaseURL+"/user", &user)
+	if err != nil {
+		return fmt.Errorf("GitHub: %v", err)
+	}
+
+	sysdig, err := NewSysdigClient(config)
+	if err != nil {
+		return fmt.Errorf("Sysdig: %v", err)
+	}
+	err = checkIntegration(ctx, sysdig, config)
+	if err != nil {
+		return fmt.Errorf("Sysdig: %v", err)
+	}
+
+	return nil
+}
+
+// checkGitHubToken calls /user to validate the token and, for classic tokens
+// that report their scopes, checks that private repositories can be listed
+func checkGitHubToken(ctx context.Context, config *Config) error {
+	github := NewGitHubClient(config.githubAPIURL(), config.Config.GithubToken)
+
+	var user struct{}
+	headers, err := github.get(ctx, github.BaseURL+"/user", &user)
+	if err != nil {
+		return err
+	}
+
+	// Fine-grained and app tokens don't send X-OAuth-Scopes
+	header, found := headers["X-Oauth-Scopes"]
+	if !found {
+		return nil
+	}
+
+	scopes := make(map[string]bool)
+	for _, scope := range strings.Split(strings.Join(header, ","), ",") {
+		scopes[strings.TrimSpace(scope)] = true
+	}
+	if !scopes["repo"] {
+		return fmt.Errorf("token lacks the repo scope (has: %s)", strings.Join(header, ","))
+	}
+	if (config.Config.Team != "" || config.Config.ExcludeTeam != "") && !scopes["read:org"] && !scopes["admin:org"] {
+		return fmt.Errorf("token lacks the read:org scope needed for teams")
+	} else if config.Config.AccountType == "all-orgs" && !scopes["read:org"] && !scopes["admin:org"] {
+		return fmt.Errorf("token lacks the read:org scope needed to list every organization")
+	}
+
+	return nil
+}
+
+// checkIntegration looks up the configured integration in Sysdig
+func checkIntegration(ctx context.Context, sysdig *SysdigClient, config *Config) error {
+	if config.Config.IntegrationID == "" {
+		return fmt.Errorf("integrationId is not set")
+	}
+
+	_, err := sysdig.do(ctx, "GET", sysdig.BaseURL+"/integrations/"+config.Config.IntegrationID, nil)
+	if apiErr, ok := err.(*SysdigError); ok && apiErr.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("integration %s not found", config.Config.IntegrationID)
+	}
+	return err
+}
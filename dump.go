@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SourceDump is the file written by -dump-existing
+type SourceDump struct {
+	Sources []Source `yaml:"sources" json:"sources"`
+}
+
+// dumpExisting writes every source registered in Sysdig to a file, as JSON
+// for .json files and YAML otherwise. Nothing is changed in Sysdig.
+func dumpExisting(config *Config, filename string) (int, error) {
+	if config.Config.SecureURL == "" || (config.Config.SecureAPIToken == "" && config.Config.Auth.ClientID == "") {
+		return 0, fmt.Errorf("secure_url and secure_api_token (or auth) are required")
+	}
+
+	sysdig, err := NewSysdigClient(config)
+	if err != nil {
+		return 0, err
+	}
+
+	sources, err := sysdig.ListSources(context.Background())
+	if err != nil {
+		return 0, fmt.Errorf("fetching existing sources: %v", err)
+	}
+
+	dump := SourceDump{Sources: sources}
+	var data []byte
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		data, err = json.MarshalIndent(dump, "", "  ")
+	} else {
+		data, err = yaml.Marshal(dump)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(sources), ioutil.WriteFile(filename, data, 0644)
+}
+
+// importSources creates the sources of a file written by -dump-existing, such
+// as to move them to another Sysdig region. The integrationId of the config
+// replaces the dumped one, since integrations differ between tenants. With
+// idempotent, sources that already exist by name are skipped.
+func importSources(config *Config, filename string, opts Options) (Summary, error) {
+	var summary Summary
+
+	err := config.Validate()
+	if err != nil {
+		return summary, fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return summary, err
+	}
+	var dump SourceDump
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		err = json.Unmarshal(data, &dump)
+	} else {
+		err = yaml.Unmarshal(data, &dump)
+	}
+	if err != nil {
+		return summary, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	messages, err := parseMessageFormat(config.Config.MessageFormat)
+	if err != nil {
+		return summary, err
+	}
+	if opts.Out == nil {
+		opts.Out = os.Stdout
+	}
+	sinks := append([]OutputSink{&consoleSink{messages: messages, opts: opts}}, opts.Sinks...)
+
+	sysdig, err := NewSysdigClient(config)
+	if err != nil {
+		return summary, err
+	}
+	ctx := context.Background()
+
+	existing := make(map[string]bool)
+	if config.Config.Idempotent {
+		sources, err := getExistingSources(ctx, sysdig)
+		if err != nil {
+			return summary, fmt.Errorf("fetching existing sources: %v", err)
+		}
+		for name := range sources {
+			existing[name] = true
+		}
+	}
+
+	if !opts.DryRun && !opts.Yes {
+		var pending []string
+		for _, source := range dump.Sources {
+			if !existing[source.Name] {
+				pending = append(pending, source.Repository)
+			}
+		}
+		if len(pending) > 0 && !(isTerminal(os.Stdout) && isTerminal(os.Stdin)) {
+			return summary, fmt.Errorf("not running interactively; pass -yes to change %d sources", len(pending))
+		} else if len(pending) > 0 && !confirm(os.Stdin, opts.Out, pending) {
+			return summary, fmt.Errorf("aborted, no sources were changed")
+		}
+	}
+
+	summary.Total = len(dump.Sources)
+	for _, source := range dump.Sources {
+		spec := source.spec()
+		spec.IntegrationID = config.Config.IntegrationID
+
+		result := Result{Repo: source.Repository, Action: "skipped"}
+		if !existing[source.Name] && !opts.DryRun {
+			result = RegisterSource(ctx, sysdig, config, withLabels(spec, ciLabels(config)))
+		} else if !existing[source.Name] {
+			result.Action = "added"
+		}
+
+		if result.Err != nil {
+			summary.fail(&result, result.Err)
+		} else if result.Action == "added" {
+			summary.Added++
+		} else {
+			result.Action = "skipped"
+			result.Reason = "source already exists"
+			summary.Skipped++
+		}
+
+		for _, sink := range sinks {
+			sink.RecordResult(result)
+		}
+		summary.Results = append(summary.Results, result)
+	}
+
+	return summary, finishSinks(sinks, summary)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// explain prints the outcome of every stage that selects and filters
+// repositories for a single repository, then whether a run would process it.
+// Stages after an exclusion are still evaluated, to show everything that
+// would have to change.
+func explain(config *Config, name, filterFile string) error {
+	err := config.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	ctx := context.Background()
+	github := NewGitHubClient(config.githubAPIURL(), config.Config.GithubToken)
+	repo, err := namedRepository(ctx, github, config, name)
+	if err != nil {
+		return err
+	}
+	repos := []Repository{*repo}
+
+	var excludedBy []string
+	stage := func(name string, excluded bool, detail string) {
+		if excluded {
+			excludedBy = append(excludedBy, name)
+			fmt.Printf("  %-26s excluded: %s\n", name, detail)
+		} else {
+			fmt.Printf("  %-26s passed: %s\n", name, detail)
+		}
+	}
+	// filter runs one of the filters of a run against the repository
+	filter := func(name string, apply func(*skipReporter) []Repository) {
+		var detail string
+		skips := &skipReporter{quiet: true, notify: func(entry skipEntry) { detail = entry.Detail }}
+		if len(apply(skips)) == 0 {
+			stage(name, true, detail)
+		} else {
+			stage(name, false, "kept")
+		}
+	}
+
+	fmt.Printf("%s:\n", repo.FullName)
+
+	// Selection, the way run picks repositories
+	listed := config.Config.RepoSelectorPlugin == "" && config.Config.CSVFile == ""
+	accountName := config.Config.AccountName
+	if config.Config.RepoSelectorPlugin != "" {
+		selected, err := selectRepositories(ctx, config.Config.RepoSelectorPlugin, accountName)
+		if err != nil {
+			return fmt.Errorf("repoSelectorPlugin: %v", err)
+		}
+		stage("repoSelectorPlugin", !containsRepository(selected, *repo), "selected by "+config.Config.RepoSelectorPlugin)
+	} else if config.Config.CSVFile != "" {
+		selected, _, err := readCSVFile(config.Config.CSVFile, accountName)
+		if err != nil {
+			return fmt.Errorf("csvFile: %v", err)
+		}
+		stage("csvFile", !containsRepository(selected, *repo), "listed in "+config.Config.CSVFile)
+	} else if len(config.Config.Orgs) > 0 || config.Config.AccountType == "all-orgs" {
+		orgs := uniqueOrgs(accountName, config.Config.Orgs)
+		if config.Config.AccountType == "all-orgs" {
+			orgs, err = github.ListUserOrgs(ctx)
+			if err != nil {
+				return fmt.Errorf("fetching organizations: %v", err)
+			}
+		}
+		member := false
+		for _, org := range orgs {
+			member = member || strings.EqualFold(org, repo.Owner.Login)
+		}
+		stage("organizations", !member, "owner "+repo.Owner.Login+" among "+strings.Join(orgs, ", "))
+	} else {
+		selected, err := github.ListRepos(ctx, config.Config.AccountType, accountName, config.Config.Team, config.Config.Affiliation)
+		if err != nil {
+			return fmt.Errorf("fetching repositories: %v", err)
+		}
+		detail := "listed for " + config.Config.AccountType + " " + accountName
+		if config.Config.Team != "" {
+			detail += ", team " + config.Config.Team
+		}
+		stage("account", !containsRepository(selected, *repo), detail)
+	}
+
+	if config.Config.ExcludeTeam != "" {
+		excluded, err := github.ListRepos(ctx, config.Config.AccountType, accountName, config.Config.ExcludeTeam, "")
+		if err != nil {
+			return fmt.Errorf("fetching excludeTeam repositories: %v", err)
+		}
+		stage("excludeTeam", containsRepository(excluded, *repo), "repository of team "+config.Config.ExcludeTeam)
+	}
+	if len(config.Config.ExcludeForksOf) > 0 {
+		var ferr error
+		filter("excludeForksOf", func(skips *skipReporter) []Repository {
+			var kept []Repository
+			kept, ferr = withoutForksOf(ctx, github, repos, config.Config.ExcludeForksOf, 1, skips)
+			return kept
+		})
+		if ferr != nil {
+			return ferr
+		}
+	}
+	if config.Config.DescriptionExcludePattern != "" {
+		pattern := regexp.MustCompile(config.Config.DescriptionExcludePattern)
+		filter("descriptionExcludePattern", func(skips *skipReporter) []Repository {
+			return withoutDescriptionMatching(repos, pattern, skips)
+		})
+	}
+	if !config.Config.IncludeDisabled {
+		filter("disabled", func(skips *skipReporter) []Repository {
+			return withoutDisabled(repos, skips)
+		})
+	}
+	if !config.Config.IncludeArchived {
+		filter("archived", func(skips *skipReporter) []Repository {
+			return withoutArchived(repos, skips)
+		})
+	}
+	if !config.Config.IncludeTemplates {
+		filter("templates", func(skips *skipReporter) []Repository {
+			return withoutTemplates(repos, skips)
+		})
+	}
+	if len(config.Config.AllowOwners) > 0 || len(config.Config.DenyOwners) > 0 {
+		filter("allowOwners/denyOwners", func(skips *skipReporter) []Repository {
+			return withOwners(repos, config.Config.AllowOwners, config.Config.DenyOwners, skips)
+		})
+	}
+	if filterFile != "" {
+		rules, err := loadFilterFile(filterFile)
+		if err != nil {
+			return fmt.Errorf("loading filter file: %v", err)
+		}
+		filter("filter file", func(skips *skipReporter) []Repository {
+			return withoutFiltered(repos, rules, skips)
+		})
+	}
+
+	// Like run, only listings are filtered on what GitHub lists
+	if config.Config.MinStars > 0 && listed {
+		filter("minStars", func(skips *skipReporter) []Repository {
+			return withMinStars(repos, config.Config.MinStars, skips)
+		})
+	}
+	if config.Config.RequireWriteAccess && listed {
+		filter("requireWriteAccess", func(skips *skipReporter) []Repository {
+			return withWriteAccess(repos, skips)
+		})
+	}
+	if visibility := config.Config.Visibility; visibility != "" && visibility != "all" && listed {
+		filter("visibility", func(skips *skipReporter) []Repository {
+			return withVisibility(repos, visibility, skips)
+		})
+	}
+
+	if len(excludedBy) > 0 {
+		fmt.Printf("Decision: excluded by %s\n", strings.Join(excludedBy, ", "))
+	} else {
+		fmt.Println("Decision: included")
+	}
+	return nil
+}
+
+// containsRepository tells whether repo is among the repositories. Those
+// without an owner, such as plugin output, match on the name alone.
+func containsRepository(repositories []Repository, repo Repository) bool {
+	for _, r := range repositories {
+		if strings.EqualFold(r.Name, repo.Name) && (r.Owner.Login == "" || strings.EqualFold(r.Owner.Login, repo.Owner.Login)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// filterRule is a line of a filter file: a glob pattern that excludes the
+// repositories it matches, or re-includes them when negated with "!"
+type filterRule struct {
+	pattern string
+	negate  bool
+}
+
+// loadFilterFile reads a .gitignore style filter file: one glob pattern per
+// line, blank lines and # comments skipped, and "!" to negate a pattern
+func loadFilterFile(filename string) ([]filterRule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []filterRule
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		rule := filterRule{pattern: text}
+		if strings.HasPrefix(text, "!") {
+			rule = filterRule{pattern: strings.TrimPrefix(text, "!"), negate: true}
+		}
+		if _, err := path.Match(rule.pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid pattern %q", filename, line, rule.pattern)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// filteredOut reports whether the rules exclude a repository. As with
+// .gitignore the last matching rule wins. Patterns containing a "/" match
+// "owner/repo", the others the repository name.
+func filteredOut(rules []filterRule, repo Repository) bool {
+	excluded := false
+	for _, rule := range rules {
+		name := repo.Name
+		if strings.Contains(rule.pattern, "/") {
+			name = repo.Owner.Login + "/" + repo.Name
+		}
+		if matched, _ := path.Match(rule.pattern, name); matched {
+			excluded = !rule.negate
+		}
+	}
+	return excluded
+}
+
+// withoutFiltered removes the repositories excluded by the filter rules
+func withoutFiltered(repositories []Repository, rules []filterRule, skips *skipReporter) []Repository {
+	var kept []Repository
+	for _, repo := range repositories {
+		if filteredOut(rules, repo) {
+			skips.skip(repo, "filter-file", "excluded by the filter file")
+			continue
+		}
+		kept = append(kept, repo)
+	}
+	return kept
+}
@@ -0,0 +1,802 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Repository struct for GitHub API response
+type Repository struct {
+	// ID stays the same when the repository is renamed
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	// Description is empty when GitHub returns null
+	Description string `json:"description"`
+	Owner       struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+	PushedAt      time.Time `json:"pushed_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	DefaultBranch string    `json:"default_branch"`
+	Fork          bool      `json:"fork"`
+	Disabled      bool      `json:"disabled"`
+	Archived      bool      `json:"archived"`
+	IsTemplate    bool      `json:"is_template"`
+	Private       bool      `json:"private"`
+	// Visibility is public, private or, on GitHub Enterprise, internal.
+	// Older servers leave it empty, see visibility
+	Visibility string `json:"visibility"`
+	Stars      int    `json:"stargazers_count"`
+	// Permissions are those of the token, nil when GitHub didn't say
+	Permissions *struct {
+		Push bool `json:"push"`
+	} `json:"permissions"`
+	// Parent is only returned when fetching a single repository
+	Parent *struct {
+		FullName string `json:"full_name"`
+	} `json:"parent"`
+}
+
+// visibility returns the visibility of a repository, falling back to the
+// private flag when GitHub didn't report it
+func (r Repository) visibility() string {
+	if r.Visibility != "" {
+		return r.Visibility
+	} else if r.Private {
+		return "private"
+	}
+	return "public"
+}
+
+// GitHubAuthError is returned when GitHub rejects the token with 401, such as
+// once a fine-grained token expired
+type GitHubAuthError struct {
+	// Message is GitHub's explanation, such as "Bad credentials"
+	Message string
+}
+
+func (e *GitHubAuthError) Error() string {
+	return "GitHub token is invalid or expired: " + e.Message
+}
+
+// errGitHubNotFound is returned when GitHub answers 404, such as for an
+// unknown organization or team
+var errGitHubNotFound = errors.New("GitHub API request failed: not found")
+
+const (
+	// githubMaxRetries is how many times a rate limited or failing request
+	// is retried before giving up
+	githubMaxRetries = 3
+	// githubMaxWait caps how long a request waits for the rate limit to
+	// reset; longer waits fail instead of stalling the run
+	githubMaxWait = 5 * time.Minute
+)
+
+// GitHubClient talks to the GitHub REST API. Every call shares the same
+// authentication, pagination and rate limit handling.
+type GitHubClient struct {
+	BaseURL string
+	Token   string
+	HTTP    *http.Client
+	// Cache, when set, makes requests conditional on the ETags it holds
+	Cache *responseCache
+	// RateLimit, when set, spaces out requests as the rate limit runs low
+	RateLimit *rateLimit
+	// Pacing, when set, spaces out every request by a minimum delay
+	Pacing *pacing
+	// MaxResponseBytes bounds the responses read, see readBody
+	MaxResponseBytes int64
+	// RetryStatuses, when set, are the only statuses retried
+	RetryStatuses []int
+}
+
+// rateLimit tracks GitHub's primary rate limit from the response headers of
+// every request of a client, whichever goroutine made it. Once fewer than
+// threshold requests remain, requests are spread evenly until the reset
+// instead of running into the limit.
+type rateLimit struct {
+	threshold int
+
+	mu        sync.Mutex
+	known     bool
+	remaining int
+	reset     time.Time
+	// next is the earliest time the next throttled request may go
+	next time.Time
+}
+
+func newRateLimit(threshold int) *rateLimit {
+	return &rateLimit{threshold: threshold}
+}
+
+// update records the rate limit reported by a response. Responses of the
+// same window can arrive out of order, so the lowest remaining count wins.
+func (r *rateLimit) update(header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	seconds, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	reset := time.Unix(seconds, 0)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.known || reset.After(r.reset) || remaining < r.remaining {
+		r.known, r.remaining, r.reset = true, remaining, reset
+	}
+}
+
+// githubLowRemaining is how few requests left in the window count as running
+// low, when githubRateLimitThreshold is lower
+const githubLowRemaining = 100
+
+// low tells whether the requests left in the window are running low
+func (r *rateLimit) low() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.known && r.remaining < max(r.threshold, githubLowRemaining) && r.reset.After(time.Now())
+}
+
+// wait blocks until the next request may be sent
+func (r *rateLimit) wait(ctx context.Context) error {
+	r.mu.Lock()
+	var delay time.Duration
+	now := time.Now()
+	if r.known && r.remaining < r.threshold && r.reset.After(now) {
+		at := r.next
+		if at.Before(now) {
+			at = now
+		}
+		if r.remaining == 0 {
+			at = r.reset.Add(time.Second)
+		} else {
+			// Count this request so concurrent callers pace on what's left
+			r.next = at.Add(time.Until(r.reset) / time.Duration(r.remaining))
+			r.remaining--
+		}
+		delay = at.Sub(now)
+	}
+	r.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// pacing spaces out the requests of a client by a minimum delay, whichever
+// goroutine makes them, as GitHub recommends against secondary rate limits
+type pacing struct {
+	delay time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// newPacing returns nil, which never waits, for a zero delay
+func newPacing(delay time.Duration) *pacing {
+	if delay <= 0 {
+		return nil
+	}
+	return &pacing{delay: delay}
+}
+
+// wait blocks until the next request may be sent
+func (p *pacing) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	now := time.Now()
+	at := p.next
+	if at.Before(now) {
+		at = now
+	}
+	p.next = at.Add(p.delay)
+	p.mu.Unlock()
+
+	if delay := at.Sub(now); delay > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return nil
+}
+
+// CachedResponse is a GitHub response kept for conditional requests
+type CachedResponse struct {
+	ETag string          `json:"etag"`
+	Link string          `json:"link,omitempty"`
+	Body json.RawMessage `json:"body"`
+}
+
+// responseCache answers conditional requests from the responses of a
+// previous run, and collects this run's responses. Only the responses used
+// in this run are kept for the next.
+type responseCache struct {
+	mu       sync.Mutex
+	previous map[string]CachedResponse
+	current  map[string]CachedResponse
+}
+
+func newResponseCache(previous map[string]CachedResponse) *responseCache {
+	return &responseCache{previous: previous, current: make(map[string]CachedResponse)}
+}
+
+func (c *responseCache) lookup(url string) (CachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, found := c.previous[url]
+	return cached, found
+}
+
+func (c *responseCache) store(url string, response CachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current[url] = response
+}
+
+// responses returns the responses to keep for the next run
+func (c *responseCache) responses() map[string]CachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current
+}
+
+// NewGitHubClient returns a client for the API at baseURL
+func NewGitHubClient(baseURL, token string) *GitHubClient {
+	return &GitHubClient{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Token:   token,
+		HTTP:    &http.Client{},
+	}
+}
+
+// ListRepos fetches the repositories of a user or organization. When a team
+// is given, only the repositories of that organization team are returned.
+// affiliation narrows the repositories of a user, such as "owner".
+func (c *GitHubClient) ListRepos(ctx context.Context, accountType, accountName, team, affiliation string) ([]Repository, error) {
+	var repositories []Repository
+	err := c.ListRepoPages(ctx, accountType, accountName, team, affiliation, func(repos []Repository) error {
+		repositories = append(repositories, repos...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repositories, nil
+}
+
+// ListRepoPages is ListRepos handing each page to page as soon as it is
+// fetched. An error returned by page stops the listing and is returned.
+func (c *GitHubClient) ListRepoPages(ctx context.Context, accountType, accountName, team, affiliation string, page func([]Repository) error) error {
+	var url string
+	if team != "" && accountType != "org" {
+		return fmt.Errorf("team can only be used with account type 'org'")
+	} else if team != "" {
+		url = fmt.Sprintf("%s/orgs/%s/teams/%s/repos", c.BaseURL, accountName, team)
+	} else if accountType == "user" {
+		url = c.BaseURL + "/user/repos"
+	} else if accountType == "org" {
+		url = fmt.Sprintf("%s/orgs/%s/repos", c.BaseURL, accountName)
+	} else {
+		return fmt.Errorf("invalid account type: must be 'user' or 'org'")
+	}
+
+	// Follow pagination until the last page
+	url += "?per_page=100"
+	if accountType == "user" && affiliation != "" {
+		url += "&affiliation=" + strings.ReplaceAll(affiliation, " ", "")
+	}
+	for url != "" {
+		var repos []Repository
+		header, err := c.get(ctx, url, &repos)
+		if err == errGitHubNotFound && team != "" {
+			return fmt.Errorf("team %q not found in organization %q", team, accountName)
+		} else if err != nil {
+			return err
+		}
+		err = page(repos)
+		if err != nil {
+			return err
+		}
+		url = parseNextLink(header.Get("Link"))
+	}
+
+	return nil
+}
+
+// defaultGitHubConcurrency bounds how many GitHub requests run at once when
+// githubConcurrency is not set. GitHub discourages many concurrent requests,
+// so it stays low.
+const defaultGitHubConcurrency = 4
+
+// OrgStatus is the outcome of listing the repositories of an organization
+type OrgStatus struct {
+	Org   string `json:"org"`
+	Repos int    `json:"repos"`
+	Error string `json:"error,omitempty"`
+	// The outcome of the organization's repositories, see Summary.attributeOrgs
+	Added   int `json:"added"`
+	Updated int `json:"updated,omitempty"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+}
+
+// ListOrgsRepos lists the repositories of several organizations, concurrency
+// at a time. An organization that fails to list doesn't stop the others; its
+// error is reported in its status. Repositories are returned in organization
+// order. A rejected token fails every organization alike, so that error is
+// returned instead.
+func (c *GitHubClient) ListOrgsRepos(ctx context.Context, orgs []string, concurrency int) ([]Repository, []OrgStatus, error) {
+	lists := make([][]Repository, len(orgs))
+	statuses := make([]OrgStatus, len(orgs))
+	var authErr error
+	var mu sync.Mutex
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for i, org := range orgs {
+		wg.Add(1)
+		go func(i int, org string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			repos, err := c.ListRepos(ctx, "org", org, "", "")
+			statuses[i] = OrgStatus{Org: org, Repos: len(repos)}
+			if err != nil {
+				statuses[i].Error = err.Error()
+			}
+			if _, ok := err.(*GitHubAuthError); ok {
+				mu.Lock()
+				authErr = err
+				mu.Unlock()
+			}
+			lists[i] = repos
+		}(i, org)
+	}
+	wg.Wait()
+
+	if authErr != nil {
+		return nil, statuses, authErr
+	}
+
+	var repositories []Repository
+	for _, repos := range lists {
+		repositories = append(repositories, repos...)
+	}
+	return repositories, statuses, nil
+}
+
+// ListUserOrgs returns the logins of the organizations the token's user
+// belongs to
+func (c *GitHubClient) ListUserOrgs(ctx context.Context) ([]string, error) {
+	var logins []string
+	url := c.BaseURL + "/user/orgs?per_page=100"
+	for url != "" {
+		var orgs []struct {
+			Login string `json:"login"`
+		}
+		header, err := c.get(ctx, url, &orgs)
+		if err != nil {
+			return nil, err
+		}
+		for _, org := range orgs {
+			logins = append(logins, org.Login)
+		}
+		url = parseNextLink(header.Get("Link"))
+	}
+	return logins, nil
+}
+
+// GetRepository fetches a single "owner/repo" repository, including the
+// fields listings leave out such as the parent of a fork
+func (c *GitHubClient) GetRepository(ctx context.Context, fullName string) (*Repository, error) {
+	var repo Repository
+	_, err := c.get(ctx, c.BaseURL+"/repos/"+fullName, &repo)
+	if err != nil {
+		return nil, err
+	}
+	return &repo, nil
+}
+
+// get fetches a GitHub API URL into v and returns the response headers.
+// Rate limited requests wait for the limit to reset and server errors are
+// retried with exponential backoff. With a cache, a 304 Not Modified is
+// answered from the cached response.
+func (c *GitHubClient) get(ctx context.Context, url string, v interface{}) (http.Header, error) {
+	var cached CachedResponse
+	var isCached bool
+	if c.Cache != nil {
+		cached, isCached = c.Cache.lookup(url)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if c.RateLimit != nil {
+			if err := c.RateLimit.wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.Pacing.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// Set authentication and headers
+		req.Header.Set("Authorization", "token "+c.Token)
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+		// Asking explicitly turns off the transport's transparent decoding,
+		// so responses go through decodedBody
+		req.Header.Set("Accept-Encoding", "gzip")
+		if isCached {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+
+		resp, err := c.HTTP.Do(req)
+		if pageTimedOut(ctx, err) && attempt < githubMaxRetries {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if c.RateLimit != nil {
+			c.RateLimit.update(resp.Header)
+		}
+
+		// A 304 has no body to decode, whatever its Content-Encoding says
+		if resp.StatusCode == http.StatusNotModified && isCached {
+			resp.Body.Close()
+			resp.Header.Set("Link", cached.Link)
+			c.Cache.store(url, cached)
+			return resp.Header, json.Unmarshal(cached.Body, v)
+		}
+
+		reader, err := decodedBody(resp)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			body, err := readBody(reader, c.MaxResponseBytes)
+			resp.Body.Close()
+			if pageTimedOut(ctx, err) && attempt < githubMaxRetries {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			err = decodeJSON(body, resp.Header.Get("Content-Type"), v)
+			if err != nil {
+				return nil, fmt.Errorf("GitHub API %v", err)
+			}
+			if c.Cache != nil && resp.Header.Get("ETag") != "" {
+				c.Cache.store(url, CachedResponse{ETag: resp.Header.Get("ETag"), Link: resp.Header.Get("Link"), Body: body})
+			}
+			return resp.Header, nil
+		}
+
+		body, _ := readBody(reader, c.MaxResponseBytes)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errGitHubNotFound
+		} else if resp.StatusCode == http.StatusUnauthorized {
+			var apiErr struct {
+				Message string `json:"message"`
+			}
+			if json.Unmarshal(body, &apiErr) != nil || apiErr.Message == "" {
+				apiErr.Message = strings.TrimSpace(string(body))
+			}
+			return nil, &GitHubAuthError{Message: apiErr.Message}
+		}
+
+		delay, retry := githubRetryDelay(resp, attempt, c.RetryStatuses)
+		if !retry || attempt >= githubMaxRetries {
+			return nil, fmt.Errorf("GitHub API request failed (%d): %s", resp.StatusCode, body)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// pageTimedOut tells whether a request failed on the HTTP client's own
+// timeout, see githubPageTimeoutSeconds, rather than the run's context
+func pageTimedOut(ctx context.Context, err error) bool {
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout() && ctx.Err() == nil
+}
+
+// decodedBody returns the body of a response, gunzipped if it is gzip encoded
+func decodedBody(resp *http.Response) (io.Reader, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp.Body, nil
+	}
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding gzip response: %v", err)
+	}
+	return reader, nil
+}
+
+// decodeJSON unmarshals a response body into v. When the body isn't the
+// expected JSON, such as a proxy's HTML login page, the error shows the
+// Content-Type and the start of the body.
+func decodeJSON(body []byte, contentType string, v interface{}) error {
+	err := json.Unmarshal(body, v)
+	if err == nil {
+		return nil
+	}
+
+	snippet := body
+	if len(snippet) > 200 {
+		snippet = snippet[:200]
+	}
+	return fmt.Errorf("returned an unexpected response (Content-Type %q): %v: %q", contentType, err, snippet)
+}
+
+// githubRetryDelay returns how long to wait before retrying a failed request,
+// and false when it should not be retried. When statuses is empty, rate
+// limits and server errors are retried; a 403 only counts as a rate limit
+// when its headers say so, since it otherwise denies access. When statuses is
+// not empty, only those statuses are retried, rate limits or not.
+func githubRetryDelay(resp *http.Response, attempt int, statuses []int) (time.Duration, bool) {
+	listed := false
+	for _, status := range statuses {
+		listed = listed || status == resp.StatusCode
+	}
+	if len(statuses) > 0 && !listed {
+		return 0, false
+	}
+
+	limited := resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests
+
+	// Secondary rate limits say how long to back off
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); limited && err == nil {
+		delay := time.Duration(seconds) * time.Second
+		return delay, delay <= githubMaxWait
+	}
+
+	// The primary rate limit says when it resets
+	if limited && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		delay := time.Until(time.Unix(reset, 0)) + time.Second
+		return delay, delay <= githubMaxWait
+	}
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || listed {
+		return time.Second << attempt, true
+	}
+
+	return 0, false
+}
+
+// repoDirs returns the directories on the default branch of a repository,
+// and whether GitHub truncated the tree because it is too large
+func repoDirs(ctx context.Context, github *GitHubClient, repo Repository) (map[string]bool, bool, error) {
+	ref := repo.DefaultBranch
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	var tree struct {
+		Tree []struct {
+			Path string `json:"path"`
+			Type string `json:"type"`
+		} `json:"tree"`
+		Truncated bool `json:"truncated"`
+	}
+	_, err := github.get(ctx, fmt.Sprintf("%s/repos/%s/%s/git/trees/%s?recursive=1", github.BaseURL, repo.Owner.Login, repo.Name, ref), &tree)
+	if err != nil {
+		return nil, false, err
+	}
+
+	dirs := make(map[string]bool)
+	for _, entry := range tree.Tree {
+		if entry.Type == "tree" {
+			dirs[entry.Path] = true
+		}
+	}
+	return dirs, tree.Truncated, nil
+}
+
+// missingFolders returns the folders that don't exist on the default branch
+// of a repository. A tree too large for GitHub to return in full can't rule
+// a folder out, so nothing is reported missing then. Globs are not checked.
+func missingFolders(ctx context.Context, github *GitHubClient, repo Repository, folders []string) ([]string, error) {
+	dirs, truncated, err := repoDirs(ctx, github, repo)
+	if err != nil || truncated {
+		return nil, err
+	}
+
+	var missing []string
+	for _, folder := range folders {
+		path := strings.Trim(folder, "/")
+		if path != "" && !isGlob(path) && !dirs[path] {
+			missing = append(missing, folder)
+		}
+	}
+	return missing, nil
+}
+
+// isGlob tells whether a folder is a pattern such as services/*/terraform
+func isGlob(folder string) bool {
+	return strings.ContainsAny(folder, "*?[")
+}
+
+// expandFolders replaces the glob folders with the directories of the
+// repository they match, in order; other folders are kept as they are. A
+// glob matching nothing is dropped.
+func expandFolders(ctx context.Context, github *GitHubClient, repo Repository, folders []string) ([]string, error) {
+	var dirs map[string]bool
+	var expanded []string
+	for _, folder := range folders {
+		if !isGlob(folder) {
+			expanded = append(expanded, folder)
+			continue
+		}
+
+		if dirs == nil {
+			var truncated bool
+			var err error
+			dirs, truncated, err = repoDirs(ctx, github, repo)
+			if err != nil {
+				return nil, fmt.Errorf("cannot expand folder %s: %v", folder, err)
+			} else if truncated {
+				return nil, fmt.Errorf("cannot expand folder %s: the repository tree is too large for GitHub to return", folder)
+			}
+		}
+
+		var matches []string
+		for dir := range dirs {
+			if ok, _ := path.Match(strings.Trim(folder, "/"), dir); ok {
+				matches = append(matches, "/"+dir)
+			}
+		}
+		sort.Strings(matches)
+		expanded = append(expanded, matches...)
+	}
+	return expanded, nil
+}
+
+// withoutRepositories removes the excluded repositories from a list, recording
+// them in the skip audit with the given reason
+func withoutRepositories(repositories, excluded []Repository, skips *skipReporter, reason, detail string) []Repository {
+	skip := make(map[string]bool)
+	for _, repo := range excluded {
+		skip[repo.Owner.Login+"/"+repo.Name] = true
+	}
+
+	var kept []Repository
+	for _, repo := range repositories {
+		if !skip[repo.Owner.Login+"/"+repo.Name] {
+			kept = append(kept, repo)
+		} else {
+			skips.record(repo, reason, detail)
+		}
+	}
+	return kept
+}
+
+// withoutForksOf removes the forks whose parent is one of the given upstream
+// "owner/repo" names. Listings don't include the parent, so each fork is
+// fetched individually, concurrency at a time.
+func withoutForksOf(ctx context.Context, github *GitHubClient, repositories []Repository, upstreams []string, concurrency int, skips *skipReporter) ([]Repository, error) {
+	excluded := make(map[string]bool)
+	for _, upstream := range upstreams {
+		excluded[strings.ToLower(upstream)] = true
+	}
+
+	// Fetch the missing parents, keeping the first error
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var fetchErr error
+	slots := make(chan struct{}, concurrency)
+	for i := range repositories {
+		if !repositories[i].Fork || repositories[i].Parent != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(repo *Repository) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			full, err := github.GetRepository(ctx, repo.FullName)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && fetchErr == nil {
+				fetchErr = fmt.Errorf("fetching parent of %s: %v", repo.FullName, err)
+			} else if err == nil {
+				repo.Parent = full.Parent
+			}
+		}(&repositories[i])
+	}
+	wg.Wait()
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+
+	var kept []Repository
+	for _, repo := range repositories {
+		if repo.Fork && repo.Parent != nil && excluded[strings.ToLower(repo.Parent.FullName)] {
+			skips.skip(repo, "fork-of", "fork of "+repo.Parent.FullName)
+			continue
+		}
+		kept = append(kept, repo)
+	}
+
+	return kept, nil
+}
+
+// parseNextLink returns the rel="next" URL of a Link header such as
+// `<url>; rel="next", <url>; rel="last"`, or "" when there is no next page.
+// Relations may be quoted or not and list several types, and URLs may
+// contain commas. Malformed entries are ignored.
+func parseNextLink(header string) string {
+	for {
+		start := strings.IndexByte(header, '<')
+		if start < 0 {
+			return ""
+		}
+		end := strings.IndexByte(header[start:], '>')
+		if end < 0 {
+			return ""
+		}
+		url := header[start+1 : start+end]
+
+		// Parameters run until the next link
+		params := header[start+end+1:]
+		header = ""
+		if next := strings.IndexByte(params, '<'); next >= 0 {
+			params, header = params[:next], params[next:]
+		}
+
+		for _, param := range strings.Split(params, ";") {
+			key, value, found := strings.Cut(param, "=")
+			if !found || !strings.EqualFold(strings.TrimSpace(key), "rel") {
+				continue
+			}
+			value = strings.TrimSpace(strings.TrimRight(strings.TrimSpace(value), ","))
+			for _, rel := range strings.Fields(strings.Trim(value, `"`)) {
+				if strings.EqualFold(rel, "next") && url != "" {
+					return url
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseNextLink(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"empty", "", ""},
+		{"next only", `<https://api.github.com/orgs/acme/repos?page=2>; rel="next"`, "https://api.github.com/orgs/acme/repos?page=2"},
+		{"next and last", `<https://api.github.com/x?page=2>; rel="next", <https://api.github.com/x?page=5>; rel="last"`, "https://api.github.com/x?page=2"},
+		{"next after others", `<https://api.github.com/x?page=1>; rel="prev", <https://api.github.com/x?page=1>; rel="first", <https://api.github.com/x?page=3>; rel="next"`, "https://api.github.com/x?page=3"},
+		{"last page", `<https://api.github.com/x?page=1>; rel="prev", <https://api.github.com/x?page=1>; rel="first"`, ""},
+		{"unquoted rel", `<https://api.github.com/x?page=2>; rel=next, <https://api.github.com/x?page=5>; rel=last`, "https://api.github.com/x?page=2"},
+		{"multiple rel types", `<https://api.github.com/x?page=5>; rel="last next"`, "https://api.github.com/x?page=5"},
+		{"case insensitive", `<https://api.github.com/x?page=2>; REL="Next"`, "https://api.github.com/x?page=2"},
+		{"extra params", `<https://api.github.com/x?page=2>; title="more"; rel="next"`, "https://api.github.com/x?page=2"},
+		{"comma in url", `<https://api.github.com/x?ids=1,2&page=2>; rel="next"`, "https://api.github.com/x?ids=1,2&page=2"},
+		{"no spaces", `<https://api.github.com/x?page=5>;rel="last",<https://api.github.com/x?page=2>;rel="next"`, "https://api.github.com/x?page=2"},
+		{"unterminated url", `<https://api.github.com/x?page=2; rel="next"`, ""},
+		{"missing url", `rel="next"`, ""},
+		{"empty url", `<>; rel="next"`, ""},
+		{"missing rel", `<https://api.github.com/x?page=2>`, ""},
+		{"next lookalike", `<https://api.github.com/x?page=2>; rel="nextpage"`, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseNextLink(test.header); got != test.want {
+				t.Errorf("parseNextLink(%q) = %q, want %q", test.header, got, test.want)
+			}
+		})
+	}
+}
+
+func TestListReposDecodesGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Accept-Encoding"); got != "gzip" {
+			t.Errorf("Accept-Encoding = %q", got)
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`[{"name": "alpha"}, {"name": "beta"}]`))
+		gz.Close()
+	}))
+	defer server.Close()
+
+	repos, err := NewGitHubClient(server.URL, "gh-token").ListRepos(context.Background(), "org", "acme", "", "")
+	if err != nil {
+		t.Fatalf("ListRepos: %v", err)
+	}
+	if len(repos) != 2 || repos[0].Name != "alpha" || repos[1].Name != "beta" {
+		t.Errorf("repos = %+v", repos)
+	}
+}
+
+func TestExpandFolders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/acme/alpha/git/trees/main" {
+			t.Errorf("unexpected request: %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"tree": [
+			{"path": "services", "type": "tree"},
+			{"path": "services/api", "type": "tree"},
+			{"path": "services/api/terraform", "type": "tree"},
+			{"path": "services/web", "type": "tree"},
+			{"path": "services/web/terraform", "type": "tree"},
+			{"path": "services/web/terraform/main.tf", "type": "blob"},
+			{"path": "services/db", "type": "tree"}
+		]}`))
+	}))
+	defer server.Close()
+
+	repo := Repository{Name: "alpha", DefaultBranch: "main"}
+	repo.Owner.Login = "acme"
+	folders, err := expandFolders(context.Background(), NewGitHubClient(server.URL, "gh-token"), repo,
+		[]string{"/", "services/*/terraform", "/docs/*"})
+	if err != nil {
+		t.Fatalf("expandFolders: %v", err)
+	}
+	want := []string{"/", "/services/api/terraform", "/services/web/terraform"}
+	if !reflect.DeepEqual(folders, want) {
+		t.Errorf("folders = %v, want %v", folders, want)
+	}
+}
+
+func TestRepositoryVisibility(t *testing.T) {
+	tests := []struct {
+		repo Repository
+		want string
+	}{
+		{Repository{Visibility: "internal", Private: true}, "internal"},
+		{Repository{Visibility: "public"}, "public"},
+		{Repository{Private: true}, "private"},
+		{Repository{}, "public"},
+	}
+	for _, test := range tests {
+		if got := test.repo.visibility(); got != test.want {
+			t.Errorf("visibility of %+v = %q, want %q", test.repo, got, test.want)
+		}
+	}
+}
+
+func TestPacingSpacesOutRequests(t *testing.T) {
+	p := newPacing(20 * time.Millisecond)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.wait(context.Background())
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("3 requests went out in %v, want at least 40ms", elapsed)
+	}
+	if err := (*pacing)(nil).wait(context.Background()); err != nil {
+		t.Errorf("nil pacing: %v", err)
+	}
+}
+
+func TestGitHubRetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		header   http.Header
+		statuses []int
+		retry    bool
+		delay    time.Duration
+	}{
+		{"bare 403", http.StatusForbidden, http.Header{}, nil, false, 0},
+		{"bare 429", http.StatusTooManyRequests, http.Header{}, nil, true, 2 * time.Second},
+		{"bare 501", http.StatusNotImplemented, http.Header{}, nil, true, 2 * time.Second},
+		{"403 with Retry-After", http.StatusForbidden, http.Header{"Retry-After": {"5"}}, nil, true, 5 * time.Second},
+		{"404", http.StatusNotFound, http.Header{}, nil, false, 0},
+		{"429 not listed", http.StatusTooManyRequests, http.Header{}, []int{503}, false, 0},
+		{"listed 503", http.StatusServiceUnavailable, http.Header{}, []int{503}, true, 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: test.status, Header: test.header}
+			delay, retry := githubRetryDelay(resp, 1, test.statuses)
+			if retry != test.retry || delay != test.delay {
+				t.Errorf("githubRetryDelay = %v, %v, want %v, %v", delay, retry, test.delay, test.retry)
+			}
+		})
+	}
+}
+
+func TestListReposAnswersNotModifiedFromCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+	}{
+		{"plain", ""},
+		// Some proxies label even an empty 304 as gzip
+		{"gzip header", "gzip"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var statuses []int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					statuses = append(statuses, http.StatusNotModified)
+					if test.encoding != "" {
+						w.Header().Set("Content-Encoding", test.encoding)
+					}
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				statuses = append(statuses, http.StatusOK)
+				w.Header().Set("ETag", `"v1"`)
+				w.Write([]byte(`[{"name": "alpha"}, {"name": "beta"}]`))
+			}))
+			defer server.Close()
+
+			// The second run starts from the responses the first one cached
+			var previous map[string]CachedResponse
+			for run := 1; run <= 2; run++ {
+				github := NewGitHubClient(server.URL, "gh-token")
+				github.Cache = newResponseCache(previous)
+				repos, err := github.ListRepos(context.Background(), "org", "acme", "", "")
+				if err != nil {
+					t.Fatalf("run %d: ListRepos: %v", run, err)
+				}
+				if len(repos) != 2 || repos[0].Name != "alpha" || repos[1].Name != "beta" {
+					t.Errorf("run %d: repos = %+v", run, repos)
+				}
+				previous = github.Cache.responses()
+			}
+			if want := []int{http.StatusOK, http.StatusNotModified}; !reflect.DeepEqual(statuses, want) {
+				t.Errorf("statuses = %v, want %v", statuses, want)
+			}
+		})
+	}
+}
+
+func TestRateLimitIsSharedByGoroutines(t *testing.T) {
+	tests := []struct {
+		name       string
+		remaining  int
+		minElapsed time.Duration
+		maxElapsed time.Duration
+	}{
+		{"plenty left", 50, 0, 50 * time.Millisecond},
+		{"running low", 5, 150 * time.Millisecond, 450 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Five requests left for half a second are spaced 100ms apart,
+			// whichever goroutine sends them
+			limit := &rateLimit{threshold: 10, known: true, remaining: test.remaining, reset: time.Now().Add(500 * time.Millisecond)}
+			start := time.Now()
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					limit.wait(context.Background())
+				}()
+			}
+			wg.Wait()
+			if elapsed := time.Since(start); elapsed < test.minElapsed || elapsed > test.maxElapsed {
+				t.Errorf("three requests took %v, want between %v and %v", elapsed, test.minElapsed, test.maxElapsed)
+			}
+		})
+	}
+
+	// Responses of a window arriving out of order keep the lowest count
+	limit := newRateLimit(10)
+	reset := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	limit.update(http.Header{"X-Ratelimit-Remaining": {"30"}, "X-Ratelimit-Reset": {reset}})
+	limit.update(http.Header{"X-Ratelimit-Remaining": {"40"}, "X-Ratelimit-Reset": {reset}})
+	if limit.remaining != 30 {
+		t.Errorf("remaining = %d, want 30", limit.remaining)
+	}
+}
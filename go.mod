@@ -2,4 +2,4 @@ module gitSources
 
 go 1.23.0
 
-require gopkg.in/yaml.v2 v2.4.0 // indirect
+require gopkg.in/yaml.v2 v2.4.0
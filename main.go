@@ -1,163 +1,370 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"os"
 	"strings"
+	"time"
+)
 
-	"gopkg.in/yaml.v2"
+// Exit codes, so pipelines can tell transient partial failures apart from
+// configuration or authentication problems
+const (
+	exitSuccess        = 0
+	exitPartialFailure = 1
+	exitFailure        = 2
+	// exitPartialListing means some organizations, or the later pages of a
+	// -pipeline listing, could not be listed, so their repositories were not
+	// even considered
+	exitPartialListing = 3
 )
 
-// Config struct to match the config.yaml file
-type Config struct {
-	Config struct {
-		SecureURL           string   `yaml:"secure_url"`
-		SecureAPIToken      string   `yaml:"secure_api_token"`
-		GithubToken         string   `yaml:"github_token"`
-		AccountType         string   `yaml:"accountType"`
-		AccountName         string   `yaml:"accountName"`
-		IntegrationID       string   `yaml:"integrationId"`
-		PRScanBranchPattern string   `yaml:"prScanBranchPattern"`
-		Folders             []string `yaml:"folders"`
-	} `yaml:"config"`
+// stringList is a flag that can be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-// Repository struct for GitHub API response
-type Repository struct {
-	Name string `json:"name"`
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
 
-// LoadConfig reads and parses the YAML configuration file
-func LoadConfig(filename string) (*Config, error) {
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return nil, err
-	}
+// hiddenFlags are diagnostic flags that usage doesn't list
+var hiddenFlags = map[string]bool{"no-tls-session-cache": true}
 
-	var config Config
-	err = yaml.Unmarshal(data, &config)
-	if err != nil {
-		return nil, err
+// defaultSettings returns the settings of the embedded defaults.yaml, indented
+// for the help
+func defaultSettings() string {
+	var settings strings.Builder
+	for _, line := range strings.Split(string(defaultConfig), "\n") {
+		// The settings are under the config key, comments are not
+		if strings.HasPrefix(line, "  ") {
+			settings.WriteString("  " + line + "\n")
+		}
 	}
-
-	return &config, nil
+	return settings.String()
 }
 
-// Fetch GitHub repositories based on account type
-func getGitHubRepositories(githubToken, accountType, accountName string) ([]string, error) {
-	var url string
-	if accountType == "user" {
-		url = "https://api.github.com/user/repos"
-	} else if accountType == "org" {
-		url = fmt.Sprintf("https://api.github.com/orgs/%s/repos", accountName)
-	} else {
-		return nil, fmt.Errorf("invalid account type: must be 'user' or 'org'")
-	}
+// usage prints the full help to stdout, so it can be piped or paged
+func usage() {
+	flag.CommandLine.SetOutput(os.Stdout)
+	fmt.Printf(`Usage: %s [plan|apply] [flags]
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
+Registers every GitHub repository of a user or organization as a git source
+of a Sysdig Secure GitHub integration. Settings are read from config.yaml in
+the current directory unless -config is given.
 
-	// Set authentication and headers
-	req.Header.Set("Authorization", "token "+githubToken)
-	req.Header.Set("Accept", "application/vnd.github.v3+json")
+Commands:
+  plan   show the sources that would change, without changing anything
+         (the default)
+  apply  create, update or remove the sources
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+From a terminal, apply lists the sources to change and asks for
+confirmation. Other runs, such as cron jobs and CI, must pass -yes.
+In GitHub Actions, failed and skipped repositories are also reported as
+workflow annotations.
+
+Flags:
+`, os.Args[0])
+
+	// Diagnostic flags are left out
+	visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	visible.SetOutput(os.Stdout)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+			visible.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	visible.PrintDefaults()
+	fmt.Print(`
+Configuration (config.yaml, under the "config" key):
+  secure_url           Sysdig Secure URL for your region
+  secure_api_token     Sysdig Secure API token (or secureApiTokenFile, or
+                       auth OAuth client credentials)
+  github_token         GitHub personal access token (or githubTokenFile)
+  accountType          "org", "user" or "all-orgs" (every organization of
+                       the token's user)
+  accountName          organization or user name
+  integrationId        ID of the Sysdig GitHub integration
+  prScanBranchPattern  branch scanned on each pull request
+  folders              folders of each repository to scan
+  See configref.yaml for every optional setting.
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("GitHub API request failed: %s", body)
+  When -config is repeated, files are merged in order: non-empty values of a
+  later file override earlier ones, maps are merged key by key and lists are
+  replaced as a whole, so an override file listing folders replaces the
+  base folders entirely. A boolean can be turned on but not back off.
+  The files are layered over these built-in defaults, so they can be left
+  out:
+`)
+	fmt.Print(defaultSettings())
+	fmt.Print(`
+  A -config URL is fetched over HTTP(S) and parsed like a file, sending
+  $GITSOURCES_CONFIG_AUTH, when set, as its Authorization header.
+
+Examples:
+  Diagnose configuration and credential problems:
+    gitSources -doctor
+  Back up the sources registered in Sysdig:
+    gitSources -dump-existing sources.yaml
+  Recreate them in another region, with that region's config:
+    gitSources apply -config eu.yaml -import sources.yaml
+  Check the configuration and credentials quickly, e.g. as a CI pre-step:
+    gitSources -validate-only
+  Find out why a repository is or isn't onboarded:
+    gitSources -explain api-gateway
+  Preview the sources that would be created:
+    gitSources plan
+  Apply production overrides on top of a base config:
+    gitSources apply -config base.yaml -config prod.yaml
+  Use the config served by a config service, with local overrides:
+    gitSources plan -config https://config.example.com/gitsources.yaml -config local.yaml
+  Override single settings of a shared config:
+    gitSources plan -set accountName=acme -set sysdigConcurrency=4
+  Register sources four at a time, only reporting failures:
+    gitSources apply -yes -concurrency 4 -quiet
+  Register a hand-picked list of repositories:
+    gh repo list acme --limit 1000 | grep api- | gitSources apply -yes -repos-from-stdin
+  Retry the repositories that failed last time:
+    gitSources apply -report run.json -only-failed-from last.json
+  Preview recreating every source of the integration from scratch:
+    gitSources plan -strategy replace
+  Start registering a large organization while it is still being listed:
+    gitSources apply -yes -pipeline -concurrency 4
+  Scheduled incremental run (requires stateFile):
+    gitSources apply -yes -since-last-run
+
+Exit codes:
+  0  every repository was added or skipped
+  1  some repositories failed
+  2  every repository failed, or a fatal configuration error
+  3  some organizations of orgs could not be listed, or a -pipeline listing
+     failed part way; the repositories that were listed were processed
+`)
+}
+
+func main() {
+	var opts Options
+	var configFiles stringList
+	var sets stringList
+	var reportFile string
+	var summaryOnly bool
+	var resultsFile string
+	var runDoctor bool
+	var validateOnly bool
+	var excludeForksOf stringList
+	var insecureSkipVerify bool
+	var noTLSSessionCache bool
+	var reposFromStdin bool
+	var payloadRepo string
+	var explainRepo string
+	var dumpFile string
+	var importFile string
+	flag.Var(&configFiles, "config", "Configuration file in YAML or JSON, - for stdin or an http(s) URL; repeat to merge several in order (default config.yaml)")
+	flag.Var(&sets, "set", "Override a setting of the configuration by its dotted path, such as accountName=acme or labels.team=platform; can be repeated")
+	flag.BoolVar(&runDoctor, "doctor", false, "Check the configuration, credentials and connectivity, then exit")
+	flag.BoolVar(&validateOnly, "validate-only", false, "Validate the configuration and ping GitHub and Sysdig with the credentials, then exit; lists and changes nothing")
+	flag.Var(&excludeForksOf, "exclude-forks-of", "Skip forks of this upstream owner/repo, can be repeated (adds to excludeForksOf)")
+	flag.StringVar(&opts.FilterFile, "filter-file", "", "Skip the repositories matching the glob patterns of this .gitignore style file (# comments, ! to re-include)")
+	flag.StringVar(&opts.SkipAudit, "skip-audit", "", "Write one JSON object per skipped repository, with the reason, to this JSON Lines file")
+	flag.StringVar(&opts.OutDir, "out-dir", "", "Save the Sysdig request and response of each repository, secrets redacted, in this directory")
+	flag.StringVar(&opts.OutDirLayout, "out-dir-layout", "flat", "Layout of -out-dir: flat, or by-status for added/, updated/, skipped/ and failed/ subdirectories")
+	flag.BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "Skip Sysdig TLS certificate verification (development against mocks only, never in production)")
+	flag.BoolVar(&noTLSSessionCache, "no-tls-session-cache", false, "DIAGNOSTIC ONLY: open a new connection, with a full TLS handshake, for every request, to rule out a proxy mishandling reused TLS sessions")
+	flag.StringVar(&dumpFile, "dump-existing", "", "Write every source registered in Sysdig to this file (YAML, or JSON for .json files), then exit without changing anything")
+	flag.StringVar(&importFile, "import", "", "Create the sources of a file written by -dump-existing, with the configured integrationId, instead of listing repositories on GitHub (honors plan, -yes and idempotent)")
+	flag.StringVar(&explainRepo, "explain", "", "Print why this repo or owner/repo is included or excluded, stage by stage through every configured filter, then exit without sending anything")
+	flag.StringVar(&payloadRepo, "print-payload", "", "Print the Sysdig payload that would be sent for this repo or owner/repo, then exit without sending anything")
+	flag.BoolVar(&reposFromStdin, "repos-from-stdin", false, "Read the repositories to process from stdin, one name or owner/repo per line, instead of listing them on GitHub")
+	flag.StringVar(&opts.OnlyFailedFrom, "only-failed-from", "", "Only process the repositories that failed in this previous -report file")
+	flag.StringVar(&resultsFile, "results", "", "Stream each repository's result as a line of JSON to this file while the run progresses")
+	flag.BoolVar(&summaryOnly, "summary-only", false, "Print only a JSON summary of the run to stdout; every other line goes to stderr")
+	flag.StringVar(&reportFile, "report", "", "Write a JSON report of the run, including created source IDs, to this file")
+	flag.BoolVar(&opts.Yes, "yes", false, "Add sources without asking for confirmation, even when more than maxRepos repositories are selected from a terminal (required when not run from a terminal, where maxRepos must be raised instead)")
+	flag.StringVar(&opts.Strategy, "strategy", "create", "create: only add missing sources; replace: delete every source of the integration and recreate them all (destructive)")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "Only show what would change, even with apply (same as plan)")
+	flag.IntVar(&opts.Concurrency, "concurrency", 0, "Number of repositories to register in parallel (overrides sysdigConcurrency, default 1)")
+	flag.IntVar(&opts.Concurrency, "concurrency-sysdig", 0, "Same as -concurrency")
+	flag.BoolVar(&opts.ConcurrencyAuto, "concurrency-auto", false, "Adapt the number of repositories registered in parallel between concurrencyAutoMin and concurrencyAutoMax: start low, ramp up while they succeed, halve on a Sysdig 429 or when GitHub's rate limit runs low")
+	flag.IntVar(&opts.GitHubConcurrency, "concurrency-github", 0, "Number of concurrent GitHub requests when listing orgs and fetching fork parents (overrides githubConcurrency, default 4)")
+	flag.BoolVar(&opts.Pipeline, "pipeline", false, "Register the repositories of each GitHub page as soon as it is listed, in listing order, so large accounts start sooner and pages listed before a failure are still processed (single user or organization only; needs -yes to apply; renamed repositories are not detected, so they get a new source and the old one stays)")
+	flag.IntVar(&opts.MaxFailures, "max-failures", 0, "Stop starting new repositories once this many have failed (0 means never)")
+	flag.BoolVar(&opts.Quiet, "quiet", false, "Only print failures and errors")
+	flag.DurationVar(&opts.Timeout, "timeout", 0, "Overall timeout for the run, such as 90s or 5m (overrides timeoutSeconds)")
+	flag.BoolVar(&opts.Verify, "verify", false, "Read each created source back from Sysdig and fail the repository if it does not match (see rollbackOnVerifyFailure)")
+	flag.BoolVar(&opts.ChangedOnly, "changed-only", false, "Only create, update or remove the sources that differ from those recorded in stateFile, without querying Sysdig for the others")
+	flag.BoolVar(&opts.IgnoreExistingErrors, "ignore-existing-errors", false, "Update existing sources Sysdig lists in an error or failed state instead of skipping them (looks up existing sources even without idempotent)")
+	flag.BoolVar(&opts.SinceLastRun, "since-last-run", false, "Only process repositories pushed since the last successful run recorded in stateFile")
+	flag.Usage = usage
+
+	// The command may come before or after the flags
+	var command string
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
+	flag.CommandLine.Parse(args)
 
-	// Parse JSON response
-	var repos []Repository
-	err = json.NewDecoder(resp.Body).Decode(&repos)
-	if err != nil {
-		return nil, err
+	// Errors go to stderr. With -summary-only, stdout holds exactly one JSON
+	// summary however the run ends, so a failure prints an empty one.
+	var summary Summary
+	var totals *summarySink
+	if summaryOnly {
+		totals = &summarySink{out: os.Stdout, start: time.Now()}
+	}
+	fail := func(a ...interface{}) {
+		fmt.Fprintln(os.Stderr, a...)
+		if totals != nil {
+			totals.fail(summary, strings.TrimSpace(fmt.Sprintln(a...)))
+		}
+		os.Exit(exitFailure)
 	}
 
-	// Extract repository names
-	var repoNames []string
-	for _, repo := range repos {
-		repoNames = append(repoNames, repo.Name)
+	if flag.NArg() == 1 && command == "" {
+		command = flag.Arg(0)
+	} else if flag.NArg() > 0 {
+		fail("Error: unexpected arguments:", strings.Join(flag.Args(), " "))
+	}
+	if command == "" {
+		command = "plan"
+	} else if command != "plan" && command != "apply" {
+		fail(fmt.Sprintf("Error: unknown command %q, must be plan or apply", command))
+	}
+	if command == "plan" {
+		opts.DryRun = true
 	}
 
-	return repoNames, nil
-}
+	// Load configuration from config.yaml unless told otherwise
+	if len(configFiles) == 0 {
+		configFiles = stringList{"config.yaml"}
+	}
 
-func main() {
-	// Load configuration from config.yaml
-	config, err := LoadConfig("config.yaml")
-	if err != nil {
-		fmt.Println("Error loading configuration:", err)
-		return
+	config, err := LoadConfig(configFiles, sets...)
+	if err == nil {
+		config.Config.ExcludeForksOf = append(config.Config.ExcludeForksOf, excludeForksOf...)
+		if insecureSkipVerify {
+			config.Config.InsecureSkipVerify = true
+		}
+		config.Config.NoTLSSessionCache = noTLSSessionCache
 	}
 
-	githubToken := config.Config.GithubToken
-	accountType := config.Config.AccountType
-	accountName := config.Config.AccountName
-	sysdigURL := fmt.Sprintf("%s/api/cspm/v1/gitProvider/gitSources", strings.TrimRight(config.Config.SecureURL, "/"))
-	apiToken := config.Config.SecureAPIToken
-	integrationID := config.Config.IntegrationID
-	prScanBranchPattern := config.Config.PRScanBranchPattern
-	folders := config.Config.Folders
+	if runDoctor {
+		if !doctor(config, err) {
+			os.Exit(exitFailure)
+		}
+		os.Exit(exitSuccess)
+	}
 
-	// Fetch repositories from GitHub
-	repositories, err := getGitHubRepositories(githubToken, accountType, accountName)
 	if err != nil {
-		fmt.Println("Error fetching repositories:", err)
-		return
+		fail("Error loading configuration:", err)
 	}
 
-	client := &http.Client{}
-
-	for _, repo := range repositories {
-		data := map[string]interface{}{
-			"source": map[string]interface{}{
-				"repository":          repo,
-				"folders":             folders,
-				"prScanBranchPattern": prScanBranchPattern,
-				"integrationId":       integrationID,
-				"name":                fmt.Sprintf("%s_source", repo),
-			},
+	if validateOnly {
+		err = validate(config)
+		if err != nil {
+			fmt.Println("FAIL", err)
+			os.Exit(exitFailure)
 		}
+		fmt.Println("PASS configuration and credentials are valid")
+		os.Exit(exitSuccess)
+	}
 
-		jsonData, err := json.Marshal(data)
+	if dumpFile != "" {
+		count, err := dumpExisting(config, dumpFile)
 		if err != nil {
-			fmt.Printf("Failed to marshal JSON for %s: %v\n", repo, err)
-			continue
+			fail("Error", err)
 		}
+		fmt.Printf("Wrote %d sources to %s\n", count, dumpFile)
+		os.Exit(exitSuccess)
+	}
 
-		req, err := http.NewRequest("POST", sysdigURL, bytes.NewBuffer(jsonData))
+	if explainRepo != "" {
+		err = explain(config, explainRepo, opts.FilterFile)
 		if err != nil {
-			fmt.Printf("Failed to create request for %s: %v\n", repo, err)
-			continue
+			fail("Error", err)
 		}
+		os.Exit(exitSuccess)
+	}
 
-		req.Header.Set("Authorization", "Bearer "+apiToken)
-		req.Header.Set("Content-Type", "application/json")
+	if payloadRepo != "" {
+		err = printPayload(config, payloadRepo)
+		if err != nil {
+			fail("Error", err)
+		}
+		os.Exit(exitSuccess)
+	}
 
-		resp, err := client.Do(req)
+	if reposFromStdin {
+		for _, file := range configFiles {
+			if file == "-" {
+				fail("Error: -repos-from-stdin cannot be used with -config -")
+			}
+		}
+		opts.Repos, err = readRepositories(os.Stdin, config.Config.AccountName)
 		if err != nil {
-			fmt.Printf("Request failed for %s: %v\n", repo, err)
-			continue
+			fail("Error reading repositories from stdin:", err)
 		}
-		defer resp.Body.Close()
+	}
 
-		body, _ := ioutil.ReadAll(resp.Body)
-		if resp.StatusCode == http.StatusOK {
-			fmt.Printf("Successfully added %s\n", repo)
-		} else {
-			fmt.Printf("Failed to add %s: %s\n", repo, body)
+	// Where results go besides the console. Notifications are best effort
+	// and never change the exit code.
+	opts.Out = os.Stdout
+	if summaryOnly {
+		// Everything printed along the way moves to stderr so stdout holds
+		// nothing but the summary
+		opts.Sinks = append(opts.Sinks, totals)
+		opts.Out = os.Stderr
+		opts.Quiet = true
+	}
+	if os.Getenv("GITHUB_ACTIONS") == "true" {
+		opts.Sinks = append(opts.Sinks, &annotationSink{out: opts.Out})
+	}
+	if reportFile != "" {
+		opts.Sinks = append(opts.Sinks, &jsonFileSink{filename: reportFile})
+	}
+	if resultsFile != "" {
+		sink, err := newNDJSONSink(resultsFile)
+		if err != nil {
+			fail("Error creating results file:", err)
 		}
+		opts.Sinks = append(opts.Sinks, sink)
+	}
+	if config.Config.WebhookURL != "" {
+		opts.Sinks = append(opts.Sinks, &webhookSink{url: config.Config.WebhookURL, out: opts.Out})
+	}
+	if config.Config.SMTPHost != "" {
+		opts.Sinks = append(opts.Sinks, &emailSink{config: config, out: opts.Out})
+	}
+
+	if importFile != "" {
+		summary, err = importSources(config, importFile, opts)
+	} else {
+		summary, err = run(config, opts)
+	}
+	if err != nil {
+		fail("Error", err)
+	}
+
+	os.Exit(exitCode(summary))
+}
+
+// exitCode picks the process exit code from the outcome of a run
+func exitCode(summary Summary) int {
+	orgFailed := false
+	for _, status := range summary.Orgs {
+		orgFailed = orgFailed || status.Error != ""
+	}
+
+	if summary.Failed == 0 && !orgFailed {
+		return exitSuccess
+	} else if summary.Failed > 0 && summary.Failed == summary.Total {
+		return exitFailure
+	} else if orgFailed {
+		return exitPartialListing
 	}
+	return exitPartialFailure
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The tests of main run the test binary again as the command, with the
+// arguments in GITSOURCES_TEST_ARGS
+func TestMain(m *testing.M) {
+	if args, found := os.LookupEnv("GITSOURCES_TEST_ARGS"); found {
+		os.Args = append([]string{"gitSources"}, strings.Fields(args)...)
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+func TestSummaryOnlyFailurePrintsOneSummary(t *testing.T) {
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "Bad credentials"}`, http.StatusUnauthorized)
+	}))
+	defer github.Close()
+	data, err := json.Marshal(newTestConfig(github.URL, "http://sysdig.invalid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		args  string
+		error string
+	}{
+		{"listing fails", "apply -yes -summary-only -config " + file, "Bad credentials"},
+		{"unknown command", "deploy -summary-only -config " + file, "unknown command"},
+		{"missing configuration", "plan -summary-only -config " + file + ".missing", "Error loading configuration"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0])
+			cmd.Env = append(os.Environ(), "GITSOURCES_TEST_ARGS="+test.args)
+			var stdout, stderr bytes.Buffer
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			err := cmd.Run()
+			if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != exitFailure {
+				t.Fatalf("exit = %v, want code %d; stderr:\n%s", err, exitFailure, stderr.String())
+			}
+
+			// Exactly one JSON value, with the error, and the error on stderr
+			decoder := json.NewDecoder(&stdout)
+			var summary map[string]interface{}
+			if err := decoder.Decode(&summary); err != nil {
+				t.Fatalf("stdout is not a JSON summary: %v", err)
+			} else if err := decoder.Decode(new(interface{})); err != io.EOF {
+				t.Errorf("stdout holds more than the summary: %v", err)
+			}
+			if message, _ := summary["error"].(string); !strings.Contains(message, test.error) {
+				t.Errorf("summary error = %q, want %s", message, test.error)
+			}
+			if !strings.Contains(stderr.String(), test.error) {
+				t.Errorf("stderr = %q, want %s", stderr.String(), test.error)
+			}
+		})
+	}
+}
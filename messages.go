@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"text/template"
+)
+
+// MessageFormat holds text/template formats for the line printed for each
+// repository. Empty formats keep the built-in wording.
+type MessageFormat struct {
+	Success string `yaml:"success" json:"success"`
+	Skip    string `yaml:"skip" json:"skip"`
+	Failure string `yaml:"failure" json:"failure"`
+}
+
+// message is what a messageFormat template can use
+type message struct {
+	Repo     string
+	Owner    string
+	Action   string
+	SourceID string
+	Status   string
+	Error    string
+	Reason   string
+	// RequestID is the X-Request-ID of the last Sysdig request
+	RequestID string
+}
+
+// messageTemplates are the parsed messageFormat templates; nil ones are not set
+type messageTemplates struct {
+	success, skip, failure *template.Template
+}
+
+// parseMessageFormat parses the templates and runs them once, so a bad
+// field name fails before any repository is processed
+func parseMessageFormat(format MessageFormat) (*messageTemplates, error) {
+	var parsed messageTemplates
+	for _, entry := range []struct {
+		name   string
+		text   string
+		target **template.Template
+	}{
+		{"success", format.Success, &parsed.success},
+		{"skip", format.Skip, &parsed.skip},
+		{"failure", format.Failure, &parsed.failure},
+	} {
+		if entry.text == "" {
+			continue
+		}
+		tmpl, err := template.New(entry.name).Parse(entry.text)
+		if err == nil {
+			err = tmpl.Execute(ioutil.Discard, message{})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("messageFormat.%s: %v", entry.name, err)
+		}
+		*entry.target = tmpl
+	}
+	return &parsed, nil
+}
+
+// print writes a message with tmpl and reports whether it did; with no
+// template the caller prints its default line
+func (m *messageTemplates) print(out io.Writer, tmpl *template.Template, msg message) bool {
+	if tmpl == nil {
+		return false
+	}
+	tmpl.Execute(out, msg)
+	fmt.Fprintln(out)
+	return true
+}
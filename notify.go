@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+// emailChunkSize is the number of failed repositories listed per email, so
+// a broad outage doesn't produce a message mail servers reject for its size
+const emailChunkSize = 200
+
+// sendSummaryEmail mails the summary of a run to the configured recipients,
+// split into several numbered emails when many repositories failed
+func sendSummaryEmail(config *Config, summary Summary) error {
+	port := config.Config.SMTPPort
+	if port == 0 {
+		port = 25
+	}
+	addr := net.JoinHostPort(config.Config.SMTPHost, strconv.Itoa(port))
+
+	var failures []string
+	for _, result := range summary.Results {
+		if result.Action == "failed" {
+			failures = append(failures, fmt.Sprintf("  %s: %s\r\n", result.Repo, result.Error))
+		}
+	}
+
+	chunks := (len(failures) + emailChunkSize - 1) / emailChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	for i := 0; i < chunks; i++ {
+		subject := fmt.Sprintf("gitSources: %d added, %d skipped, %d failed", summary.Added, summary.Skipped, summary.Failed)
+		if chunks > 1 {
+			subject += fmt.Sprintf(" (%d/%d)", i+1, chunks)
+		}
+
+		var body strings.Builder
+		fmt.Fprintf(&body, "%s\r\n", summary)
+		if len(failures) > 0 {
+			end := (i + 1) * emailChunkSize
+			if end > len(failures) {
+				end = len(failures)
+			}
+			fmt.Fprintf(&body, "\r\nFailed repositories:\r\n%s", strings.Join(failures[i*emailChunkSize:end], ""))
+		}
+
+		msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s",
+			config.Config.SMTPFrom, strings.Join(config.Config.SMTPTo, ", "), subject, body.String())
+
+		err := smtp.SendMail(addr, nil, config.Config.SMTPFrom, config.Config.SMTPTo, []byte(msg))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExpiryMargin is how long before its expiry an access token is
+// replaced, so it doesn't expire while a request is in flight
+const tokenExpiryMargin = 30 * time.Second
+
+// oauthToken fetches Sysdig access tokens with the OAuth client credentials
+// grant, and fetches a new one when the current one expires
+type oauthToken struct {
+	http     *http.Client
+	auth     SysdigAuth
+	maxBytes int64
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// newOAuthToken returns the token source of the auth settings, or nil when
+// they are not set and secure_api_token is used instead
+func newOAuthToken(client *http.Client, auth SysdigAuth, maxBytes int64) *oauthToken {
+	if auth.ClientID == "" {
+		return nil
+	}
+	return &oauthToken{http: client, auth: auth, maxBytes: maxBytes}
+}
+
+// accessToken returns a valid access token, fetching one if needed
+func (t *oauthToken) accessToken(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && (t.expiry.IsZero() || time.Now().Before(t.expiry)) {
+		return t.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {t.auth.ClientID},
+		"client_secret": {t.auth.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", t.auth.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := t.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := readBody(resp.Body, t.maxBytes)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return "", fmt.Errorf("decoding token response: %v", err)
+	} else if token.AccessToken == "" {
+		return "", fmt.Errorf("token response has no access_token")
+	}
+
+	// Tokens without an expiry are kept for the whole run
+	t.token = token.AccessToken
+	t.expiry = time.Time{}
+	if token.ExpiresIn > 0 {
+		t.expiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - tokenExpiryMargin)
+	}
+	return t.token, nil
+}
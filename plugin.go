@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// selectRepositories runs the repoSelectorPlugin command and reads the
+// repositories it prints, in the same format as -repos-from-stdin. The
+// command is split on spaces and run without a shell; its stderr is passed
+// through.
+func selectRepositories(ctx context.Context, command, owner string) ([]Repository, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("repoSelectorPlugin is empty")
+	}
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("running %s: %v", args[0], err)
+	}
+
+	return readRepositories(&out, owner)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// progress prints a "processing n/total" counter with a rough ETA to stderr.
+// A disabled progress does nothing, so callers don't need to check.
+type progress struct {
+	enabled bool
+	total   int
+	done    int
+	start   time.Time
+}
+
+func newProgress(total int, enabled bool) *progress {
+	return &progress{enabled: enabled, total: total, start: time.Now()}
+}
+
+// increment records a completed repository and redraws the counter
+func (p *progress) increment() {
+	p.done++
+	if !p.enabled {
+		return
+	}
+
+	line := fmt.Sprintf("processing %d/%d", p.done, p.total)
+	if p.done < p.total {
+		perRepo := time.Since(p.start) / time.Duration(p.done)
+		eta := perRepo * time.Duration(p.total-p.done)
+		line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[K%s", line)
+}
+
+// clear erases the counter so regular output starts on a clean line
+func (p *progress) clear() {
+	if p.enabled && p.done > 0 {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
+
+// lockedWriter writes under the lock the workers hold to print, clearing the
+// progress counter first like they do
+type lockedWriter struct {
+	mu       *sync.Mutex
+	progress *progress
+	out      io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.progress.clear()
+	return w.out.Write(p)
+}
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,1678 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options controls how a run is carried out, independently of the config file
+type Options struct {
+	DryRun bool
+	// Concurrency is how many repositories are registered at once and
+	// GitHubConcurrency how many GitHub requests run at once; zero uses
+	// sysdigConcurrency and githubConcurrency from the config
+	Concurrency       int
+	GitHubConcurrency int
+	Quiet             bool
+	SinceLastRun      bool
+	// IgnoreExistingErrors updates existing sources in an error state
+	// instead of skipping them
+	IgnoreExistingErrors bool
+	ChangedOnly          bool
+	Verify               bool
+	// MaxFailures stops the run once that many repositories failed
+	MaxFailures int
+	Timeout     time.Duration
+	OutDir      string
+	// OutDirLayout is "flat", the default, or "by-status" to save artifacts
+	// in a subdirectory per outcome, such as failed/
+	OutDirLayout string
+	FilterFile   string
+	// Sinks receive the results and summary along with the console, which
+	// prints to Out, stdout when nil
+	Sinks     []OutputSink
+	Out       io.Writer
+	SkipAudit string
+	// Strategy is "create", the default, or "replace" to delete every source
+	// of the integration and create them all again
+	Strategy string
+	// OnlyFailedFrom is a previous report whose failed repositories are the
+	// only ones processed
+	OnlyFailedFrom string
+	Yes            bool
+	// Repos, when set, are processed instead of listing the account's
+	// repositories on GitHub
+	Repos []Repository
+	// ConcurrencyAuto adapts the number of repositories registered at once
+	// to the rate limits, see workerLimit
+	ConcurrencyAuto bool
+	// Pipeline registers the repositories of each GitHub page as soon as it
+	// is listed, instead of once every page is
+	Pipeline bool
+}
+
+// Summary counts the outcome of every repository processed by a run
+type Summary struct {
+	Total       int      `json:"total"`
+	Added       int      `json:"added"`
+	Updated     int      `json:"updated"`
+	Removed     int      `json:"removed"`
+	Skipped     int      `json:"skipped"`
+	Failed      int      `json:"failed"`
+	FailedRepos []string `json:"failedRepos"`
+	// FailureCategories counts the failures by errorCategory
+	FailureCategories map[string]int `json:"failureCategories,omitempty"`
+	// Orgs is the listing status of each organization when orgs is set
+	Orgs    []OrgStatus `json:"orgs,omitempty"`
+	Results []Result    `json:"results"`
+}
+
+// Result is the outcome for a single repository
+type Result struct {
+	Repo     string `json:"repo"`
+	Owner    string `json:"owner,omitempty"`
+	Action   string `json:"action"`
+	SourceID string `json:"sourceId,omitempty"`
+	// Status is the status Sysdig reported for a created source
+	Status   string `json:"status,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Category string `json:"category,omitempty"`
+	// Reason says why a repository was skipped
+	Reason string `json:"reason,omitempty"`
+	// RequestID is the X-Request-ID of the last Sysdig request made for the
+	// repository, and SysdigRequestID the one Sysdig answered with
+	RequestID       string `json:"requestId,omitempty"`
+	SysdigRequestID string `json:"sysdigRequestId,omitempty"`
+	// Changes are the fields an update changes, see diffSources
+	Changes []string `json:"changes,omitempty"`
+	// StatusCode is the HTTP status of the last Sysdig response, if any
+	StatusCode int `json:"statusCode,omitempty"`
+	// Err is the error of a failure, whose message is Error
+	Err error `json:"-"`
+	// Duration is how long the repository took to process
+	Duration time.Duration `json:"-"`
+
+	removal bool
+}
+
+func (s Summary) String() string {
+	var line string
+	if s.Updated > 0 || s.Removed > 0 {
+		line = fmt.Sprintf("Processed %d repositories: %d added, %d updated, %d removed, %d skipped, %d failed", s.Total, s.Added, s.Updated, s.Removed, s.Skipped, s.Failed)
+	} else {
+		line = fmt.Sprintf("Processed %d repositories: %d added, %d skipped, %d failed", s.Total, s.Added, s.Skipped, s.Failed)
+	}
+
+	// Most frequent categories first, such as "(3 auth, 2 rate-limited)"
+	if len(s.FailureCategories) > 0 {
+		var categories []string
+		for category := range s.FailureCategories {
+			categories = append(categories, category)
+		}
+		sort.Slice(categories, func(i, j int) bool {
+			a, b := categories[i], categories[j]
+			if s.FailureCategories[a] != s.FailureCategories[b] {
+				return s.FailureCategories[a] > s.FailureCategories[b]
+			}
+			return a < b
+		})
+		for i, category := range categories {
+			categories[i] = fmt.Sprintf("%d %s", s.FailureCategories[category], category)
+		}
+		line += " (" + strings.Join(categories, ", ") + ")"
+	}
+	return line
+}
+
+// fail records a repository that failed with err
+func (s *Summary) fail(result *Result, err error) {
+	result.Action = "failed"
+	result.Err = err
+	result.Error = err.Error()
+	result.Category = errorCategory(err)
+	s.Failed++
+	s.FailedRepos = append(s.FailedRepos, result.Repo)
+	if s.FailureCategories == nil {
+		s.FailureCategories = make(map[string]int)
+	}
+	s.FailureCategories[result.Category]++
+}
+
+// errorCategory classifies a failure for triage: auth, rate-limited,
+// validation, conflict, server, timeout, network or other
+func errorCategory(err error) string {
+	var apiErr *SysdigError
+	var netErr net.Error
+	if errors.As(err, &apiErr) {
+		switch code := apiErr.StatusCode; {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return "auth"
+		case code == http.StatusTooManyRequests:
+			return "rate-limited"
+		case code == http.StatusConflict:
+			return "conflict"
+		case code >= 500:
+			return "server"
+		case code >= 400:
+			return "validation"
+		}
+	} else if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return "timeout"
+	} else if errors.As(err, &netErr) {
+		return "network"
+	}
+	return "other"
+}
+
+// writeReport saves the summary of a run as JSON
+func writeReport(filename string, summary Summary) error {
+	return writeJSON(filename, summary)
+}
+
+// errStopped ends a pipelined listing once no more repositories are taken
+var errStopped = errors.New("stopped")
+
+// run fetches the repositories described by the configuration and registers
+// a Sysdig source for each of them
+func run(config *Config, opts Options) (Summary, error) {
+	var summary Summary
+	start := time.Now()
+	if opts.Out == nil {
+		opts.Out = os.Stdout
+	}
+
+	err := config.Validate()
+	if err != nil {
+		return summary, fmt.Errorf("invalid configuration: %v", err)
+	}
+	err = checkOptions(config, opts)
+	if err != nil {
+		return summary, err
+	}
+	accountName := config.Config.AccountName
+
+	// Bound the whole run; the -timeout flag wins over timeoutSeconds
+	ctx := context.Background()
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = time.Duration(config.Config.TimeoutSeconds) * time.Second
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var state *State
+	if config.Config.StateFile != "" {
+		state, err = loadState(config.Config.StateFile)
+		if err != nil {
+			return summary, fmt.Errorf("loading state: %v", err)
+		}
+	}
+
+	skips, err := newSkipReporter(opts.SkipAudit, opts.Quiet)
+	if err != nil {
+		return summary, err
+	}
+	defer skips.close()
+	skips.out = opts.Out
+	for _, sink := range opts.Sinks {
+		if annotations, ok := sink.(*annotationSink); ok {
+			skips.notify = annotations.skip
+		}
+	}
+
+	filter, err := newRepoFilter(config, opts, state, skips)
+	if err != nil {
+		return summary, err
+	}
+
+	// Every result goes to the console and to the sinks enabled by flags
+	messages, err := parseMessageFormat(config.Config.MessageFormat)
+	if err != nil {
+		return summary, err
+	}
+	sinks := append([]OutputSink{&consoleSink{messages: messages, opts: opts}}, opts.Sinks...)
+
+	githubConcurrency := opts.GitHubConcurrency
+	if githubConcurrency == 0 {
+		githubConcurrency = config.Config.GithubConcurrency
+	}
+	if githubConcurrency < 1 {
+		githubConcurrency = defaultGitHubConcurrency
+	}
+	github := newRunGitHubClient(config, opts, state)
+	filter.github, filter.concurrency = github, githubConcurrency
+
+	repositories, listed, err := listRepositories(ctx, config, opts, github, githubConcurrency, &summary)
+	if err != nil {
+		return summary, err
+	}
+	filter.listed = listed
+
+	// Drop the repositories owned by the excluded team
+	if config.Config.ExcludeTeam != "" {
+		filter.excludedTeam, err = github.ListRepos(ctx, config.Config.AccountType, accountName, config.Config.ExcludeTeam, "")
+		if err != nil {
+			return summary, fmt.Errorf("fetching excludeTeam repositories: %v", err)
+		}
+	}
+	repositories, err = filter.apply(ctx, repositories)
+	if err != nil {
+		return summary, err
+	}
+	sortRepositories(repositories, config.Config.SortOrder)
+
+	plan, err := planChanges(config, opts, state, repositories)
+	if err != nil {
+		return summary, err
+	}
+	summary.Total = len(plan.repositories) + len(plan.removed)
+
+	// Guard against a misconfigured account pulling in a huge org. Unattended
+	// runs always pass -yes, so only a person at a terminal can waive it.
+	max := config.Config.MaxRepos
+	interactive := isTerminal(os.Stdout) && isTerminal(os.Stdin)
+	if max > 0 && len(plan.repositories) > max && !opts.DryRun && !interactive {
+		return summary, fmt.Errorf("%d repositories selected, more than maxRepos (%d); raise maxRepos to proceed when not running interactively", len(plan.repositories), max)
+	} else if max > 0 && len(plan.repositories) > max && !opts.DryRun && !opts.Yes {
+		return summary, fmt.Errorf("%d repositories selected, more than maxRepos (%d); pass -yes to proceed or raise maxRepos", len(plan.repositories), max)
+	}
+
+	// Nothing changed, so Sysdig isn't even queried
+	if opts.ChangedOnly && summary.Total == 0 {
+		if !opts.DryRun {
+			state.LastRun = start
+			state.GitHubCache = github.Cache.responses()
+			err = state.save(config.Config.StateFile)
+			if err != nil {
+				return summary, fmt.Errorf("saving state: %v", err)
+			}
+		}
+		summary.attributeOrgs()
+		return summary, finishSinks(sinks, summary)
+	}
+
+	sysdig, err := NewSysdigClient(config)
+	if err != nil {
+		return summary, err
+	}
+	// Bad client credentials would fail every repository
+	if sysdig.OAuth != nil {
+		_, err = sysdig.OAuth.accessToken(ctx)
+		if err != nil {
+			return summary, fmt.Errorf("fetching Sysdig access token: %v", err)
+		}
+	}
+
+	reg, removals, err := newRegistration(ctx, config, opts, state, plan, github, sysdig)
+	if err != nil {
+		return summary, err
+	}
+	summary.Total = len(plan.repositories) + len(removals)
+
+	// Real changes need a confirmation: a prompt when a person is watching,
+	// -yes otherwise so unattended runs never block on stdin
+	if !opts.DryRun && !opts.Yes {
+		var pending []string
+		for i, repo := range plan.repositories {
+			if reg.changed[plan.names[i]] {
+				pending = append(pending, repo.Name+" (update)")
+			} else if !reg.existing[plan.names[i]] {
+				pending = append(pending, repo.Name)
+			}
+		}
+		for _, r := range removals {
+			pending = append(pending, r.Repo+" (remove)")
+		}
+		if len(pending) > 0 && !interactive {
+			return summary, fmt.Errorf("not running interactively; pass -yes to change %d sources", len(pending))
+		} else if len(pending) > 0 && !confirm(os.Stdin, opts.Out, pending) {
+			return summary, fmt.Errorf("aborted, no sources were changed")
+		}
+	}
+
+	limit := newRunLimit(config, opts, github, sysdig)
+
+	var artifacts *artifactWriter
+	if opts.OutDir != "" {
+		artifacts, err = newArtifactWriter(opts.OutDir, opts.OutDirLayout == "by-status")
+		if err != nil {
+			return summary, err
+		}
+	}
+
+	removeSources(ctx, sysdig, removals, state, sinks, &summary, opts.DryRun)
+
+	// The total isn't known while pages are still coming
+	progress := newProgress(len(plan.repositories), !opts.Quiet && !opts.Pipeline && isTerminal(os.Stdout))
+
+	// The workers register repositories at once and record them one at a
+	// time under mu, along with anything else they print
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	reg.console = &lockedWriter{mu: &mu, progress: progress, out: opts.Out}
+	results := &tally{summary: &summary, state: state, sinks: sinks, skips: skips, artifacts: artifacts, progress: progress,
+		renames: plan.renames, out: opts.Out, dryRun: opts.DryRun}
+
+	// The workers take the repositories from jobs: the selection, or with
+	// -pipeline each page as soon as it is listed and filtered
+	jobs := make(chan job)
+	stop := make(chan struct{})
+	var listErr error
+	// The lister reports the repositories its filters skip while the workers
+	// print, so it writes under their lock
+	if opts.Pipeline {
+		skips.out = reg.console
+	}
+	go func() {
+		defer close(jobs)
+		if !opts.Pipeline {
+			for i, repo := range plan.repositories {
+				select {
+				case jobs <- job{repo, plan.names[i]}:
+				case <-stop:
+					return
+				}
+			}
+			return
+		}
+
+		listErr = listPipeline(ctx, config, github, filter, jobs, stop, func() {
+			mu.Lock()
+			summary.Total++
+			mu.Unlock()
+		})
+	}()
+
+	started := 0
+	for j := range jobs {
+		limit.acquire()
+
+		// Circuit breaker: repositories already in flight finish, no new
+		// ones start
+		mu.Lock()
+		tripped := opts.MaxFailures > 0 && summary.Failed >= opts.MaxFailures
+		mu.Unlock()
+		if tripped {
+			limit.release(false)
+			close(stop)
+			progress.clear()
+			if opts.Pipeline {
+				fmt.Fprintf(opts.Out, "Stopping after %d failures (-max-failures), the repositories left are not processed\n", opts.MaxFailures)
+			} else {
+				fmt.Fprintf(opts.Out, "Stopping after %d failures (-max-failures), %d repositories not processed\n", opts.MaxFailures, len(plan.repositories)-started)
+			}
+			break
+		}
+		started++
+
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			outcome := reg.register(ctx, j.repo, j.name)
+			mu.Lock()
+			results.record(j.repo, j.name, outcome)
+			mu.Unlock()
+			limit.release(outcome.err == nil)
+		}(j)
+	}
+
+	// Let the lister notice a stop before waiting for it
+	for range jobs {
+	}
+	wg.Wait()
+	progress.clear()
+	if opts.ConcurrencyAuto && !opts.Quiet {
+		fmt.Fprintf(opts.Out, "Concurrency ended at %d (-concurrency-auto)\n", limit.current())
+	}
+
+	// Remember the sources, and this run so the next -since-last-run starts
+	// from here if everything went through
+	if state != nil && !opts.DryRun {
+		if summary.Failed == 0 && listErr == nil {
+			state.LastRun = start
+		}
+		state.GitHubCache = github.Cache.responses()
+		err = state.save(config.Config.StateFile)
+		if err != nil {
+			return summary, fmt.Errorf("saving state: %v", err)
+		}
+	}
+
+	// With -pipeline, the pages listed before a failure are processed. The
+	// listing then fails like an organization that could not be listed, so
+	// the exit code tells partial progress from a run that did nothing.
+	_, authFailed := listErr.(*GitHubAuthError)
+	if listErr != nil && !authFailed && summary.Total > 0 {
+		fmt.Fprintf(opts.Out, "Warning: could not list every repository of %s: %v\n", accountName, listErr)
+		summary.Orgs = []OrgStatus{{Org: accountName, Repos: summary.Total, Error: listErr.Error()}}
+	}
+	summary.attributeOrgs()
+	err = finishSinks(sinks, summary)
+	if err != nil {
+		return summary, err
+	}
+
+	if authFailed {
+		return summary, listErr
+	} else if listErr != nil && summary.Total == 0 {
+		return summary, fmt.Errorf("fetching repositories: %v", listErr)
+	}
+	return summary, nil
+}
+
+// checkOptions rejects the options that contradict each other or the
+// configuration
+func checkOptions(config *Config, opts Options) error {
+	if config.Config.StateFile == "" && opts.SinceLastRun {
+		return fmt.Errorf("-since-last-run requires a stateFile in the configuration")
+	} else if config.Config.StateFile == "" && opts.ChangedOnly {
+		return fmt.Errorf("-changed-only requires a stateFile in the configuration")
+	}
+	if opts.OutDirLayout != "" && opts.OutDirLayout != "flat" && opts.OutDirLayout != "by-status" {
+		return fmt.Errorf("invalid -out-dir-layout %q: must be flat or by-status", opts.OutDirLayout)
+	}
+	if opts.Strategy != "" && opts.Strategy != "create" && opts.Strategy != "replace" {
+		return fmt.Errorf("invalid -strategy %q: must be create or replace", opts.Strategy)
+	} else if opts.Strategy == "replace" && opts.ChangedOnly {
+		return fmt.Errorf("-strategy replace cannot be combined with -changed-only")
+	}
+	if opts.ChangedOnly && (opts.SinceLastRun || opts.Repos != nil || opts.OnlyFailedFrom != "") {
+		// Repositories left out of the selection would be removed
+		return fmt.Errorf("-changed-only cannot be combined with -since-last-run, -repos-from-stdin or -only-failed-from")
+	}
+	// Pipelined runs never hold the whole selection, which the confirmation,
+	// maxRepos, removals and name disambiguation all need. Rename detection
+	// needs it too, and is left out, see -pipeline.
+	if opts.Pipeline && (opts.ChangedOnly || opts.Strategy == "replace" || opts.Repos != nil) {
+		return fmt.Errorf("-pipeline cannot be combined with -changed-only, -strategy replace or -repos-from-stdin")
+	} else if opts.Pipeline && (config.Config.RepoSelectorPlugin != "" || config.Config.CSVFile != "" || len(config.Config.Orgs) > 0 || config.Config.AccountType == "all-orgs") {
+		return fmt.Errorf("-pipeline only applies to the listing of a single user or organization, not to repoSelectorPlugin, csvFile, orgs or all-orgs")
+	} else if opts.Pipeline && (config.Config.MaxRepos > 0 || config.Config.DisambiguateNames) {
+		return fmt.Errorf("-pipeline cannot be combined with maxRepos or disambiguateNames")
+	} else if opts.Pipeline && !opts.Yes && !opts.DryRun {
+		return fmt.Errorf("-pipeline needs -yes, as there is no list of changes to confirm up front")
+	}
+	if opts.ConcurrencyAuto && opts.Concurrency > 0 {
+		return fmt.Errorf("-concurrency-auto cannot be combined with -concurrency")
+	} else if opts.ConcurrencyAuto && (config.Config.ConcurrencyAutoMin < 1 || config.Config.ConcurrencyAutoMax < config.Config.ConcurrencyAutoMin) {
+		return fmt.Errorf("-concurrency-auto needs concurrencyAutoMin of at least 1 and concurrencyAutoMax of at least concurrencyAutoMin")
+	}
+	return nil
+}
+
+// newRunGitHubClient returns the GitHub client of a run, set up with the
+// cache of the state, if any, and the configured limits
+func newRunGitHubClient(config *Config, opts Options, state *State) *GitHubClient {
+	github := NewGitHubClient(config.githubAPIURL(), config.Config.GithubToken)
+
+	// Conditional requests spare the rate limit when listings didn't change
+	if state != nil {
+		github.Cache = newResponseCache(state.GitHubCache)
+	}
+	if config.Config.NoTLSSessionCache {
+		github.HTTP.Transport = withoutConnectionReuse(http.DefaultTransport.(*http.Transport).Clone())
+	}
+	if config.Config.GithubPageTimeoutSeconds > 0 {
+		github.HTTP.Timeout = time.Duration(config.Config.GithubPageTimeoutSeconds) * time.Second
+	}
+	github.RetryStatuses = config.Config.GithubRetryStatuses
+	if config.Config.GithubRateLimitThreshold > 0 || opts.ConcurrencyAuto {
+		github.RateLimit = newRateLimit(config.Config.GithubRateLimitThreshold)
+	}
+	github.MaxResponseBytes = config.Config.MaxResponseBytes
+	github.Pacing = newPacing(time.Duration(config.Config.GithubRequestDelayMs) * time.Millisecond)
+	return github
+}
+
+// listRepositories returns the repositories of a run: those given, those a
+// plugin or csvFile selects, or the account's on GitHub, along with whether
+// they come from a GitHub listing. With -pipeline, the account is listed page
+// by page later on, see listPipeline, and none are returned.
+func listRepositories(ctx context.Context, config *Config, opts Options, github *GitHubClient, concurrency int, summary *Summary) ([]Repository, bool, error) {
+	accountType := config.Config.AccountType
+	accountName := config.Config.AccountName
+	repositories := opts.Repos
+	listed := repositories == nil && config.Config.RepoSelectorPlugin == "" && config.Config.CSVFile == ""
+
+	var err error
+	if repositories == nil && config.Config.RepoSelectorPlugin != "" {
+		repositories, err = selectRepositories(ctx, config.Config.RepoSelectorPlugin, accountName)
+		if err != nil {
+			return nil, false, fmt.Errorf("repoSelectorPlugin: %v", err)
+		}
+	} else if repositories == nil && config.Config.CSVFile != "" {
+		repositories, _, err = readCSVFile(config.Config.CSVFile, accountName)
+		if err != nil {
+			return nil, false, fmt.Errorf("csvFile: %v", err)
+		}
+	} else if repositories == nil && (len(config.Config.Orgs) > 0 || accountType == "all-orgs") {
+		orgs := uniqueOrgs(accountName, config.Config.Orgs)
+		if accountType == "all-orgs" {
+			orgs, err = github.ListUserOrgs(ctx)
+			if _, ok := err.(*GitHubAuthError); ok {
+				return nil, false, err
+			} else if err != nil {
+				return nil, false, fmt.Errorf("fetching organizations: %v", err)
+			} else if len(orgs) == 0 {
+				return nil, false, fmt.Errorf("fetching organizations: the token's user belongs to no organization")
+			}
+		}
+		repositories, summary.Orgs, err = github.ListOrgsRepos(ctx, orgs, concurrency)
+		if err != nil {
+			return nil, false, err
+		}
+		failed := 0
+		for _, status := range summary.Orgs {
+			if status.Error != "" {
+				failed++
+				fmt.Fprintf(opts.Out, "Warning: could not list the repositories of %s: %s\n", status.Org, status.Error)
+			}
+		}
+		if failed == len(summary.Orgs) {
+			return nil, false, fmt.Errorf("fetching repositories: no organization could be listed")
+		} else if failed > 0 && opts.ChangedOnly {
+			// The missing repositories would read as removed
+			return nil, false, fmt.Errorf("fetching repositories: %d organizations could not be listed", failed)
+		}
+	} else if repositories == nil && !opts.Pipeline {
+		repositories, err = github.ListRepos(ctx, accountType, accountName, config.Config.Team, config.Config.Affiliation)
+		if _, ok := err.(*GitHubAuthError); ok {
+			return nil, false, err
+		} else if err != nil {
+			return nil, false, fmt.Errorf("fetching repositories: %v", err)
+		}
+	}
+	return repositories, listed, nil
+}
+
+// repoFilter leaves out the repositories the configuration and options
+// exclude, from the whole selection or with -pipeline from each page
+type repoFilter struct {
+	config *Config
+	opts   Options
+	state  *State
+	skips  *skipReporter
+	rules  []filterRule
+	// retry holds the repositories of -only-failed-from
+	retry        map[string]bool
+	excludedTeam []Repository
+	github       *GitHubClient
+	concurrency  int
+	// listed is set for repositories listed on GitHub, which are the only
+	// ones to carry stars, permissions and visibility
+	listed bool
+}
+
+// newRepoFilter returns the filter of a run, with the rules of -filter-file
+// and the failures of -only-failed-from loaded
+func newRepoFilter(config *Config, opts Options, state *State, skips *skipReporter) (*repoFilter, error) {
+	filter := &repoFilter{config: config, opts: opts, state: state, skips: skips}
+	var err error
+	if opts.FilterFile != "" {
+		filter.rules, err = loadFilterFile(opts.FilterFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading filter file: %v", err)
+		}
+	}
+	if opts.OnlyFailedFrom != "" {
+		filter.retry, err = failedInReport(opts.OnlyFailedFrom)
+		if err != nil {
+			return nil, fmt.Errorf("reading report: %v", err)
+		}
+	}
+	return filter, nil
+}
+
+// apply returns the repositories the filters keep, recording the others as
+// skipped
+func (f *repoFilter) apply(ctx context.Context, repositories []Repository) ([]Repository, error) {
+	config, opts, skips := f.config, f.opts, f.skips
+	if config.Config.ExcludeTeam != "" {
+		repositories = withoutRepositories(repositories, f.excludedTeam, skips, "exclude-team", "in excludeTeam "+config.Config.ExcludeTeam)
+	}
+
+	if len(config.Config.ExcludeForksOf) > 0 {
+		var err error
+		repositories, err = withoutForksOf(ctx, f.github, repositories, config.Config.ExcludeForksOf, f.concurrency, skips)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Config.DescriptionExcludePattern != "" {
+		pattern := regexp.MustCompile(config.Config.DescriptionExcludePattern)
+		repositories = withoutDescriptionMatching(repositories, pattern, skips)
+	}
+
+	if !config.Config.IncludeDisabled {
+		repositories = withoutDisabled(repositories, skips)
+	}
+
+	if !config.Config.IncludeArchived {
+		repositories = withoutArchived(repositories, skips)
+	}
+
+	if !config.Config.IncludeTemplates {
+		repositories = withoutTemplates(repositories, skips)
+	}
+
+	if len(config.Config.AllowOwners) > 0 || len(config.Config.DenyOwners) > 0 {
+		repositories = withOwners(repositories, config.Config.AllowOwners, config.Config.DenyOwners, skips)
+	}
+
+	if len(f.rules) > 0 {
+		repositories = withoutFiltered(repositories, f.rules, skips)
+	}
+
+	if f.retry != nil {
+		repositories = onlyRepositories(repositories, f.retry)
+		if !opts.Quiet && !opts.Pipeline {
+			fmt.Fprintf(opts.Out, "Retrying %d repositories that failed in %s\n", len(repositories), opts.OnlyFailedFrom)
+		}
+	}
+
+	// Only listings say how many stars a repository has
+	if config.Config.MinStars > 0 && f.listed {
+		repositories = withMinStars(repositories, config.Config.MinStars, skips)
+	}
+
+	// Likewise for the token's permissions and the visibility
+	if config.Config.RequireWriteAccess && f.listed {
+		repositories = withWriteAccess(repositories, skips)
+	}
+	if visibility := config.Config.Visibility; visibility != "" && visibility != "all" && f.listed {
+		repositories = withVisibility(repositories, visibility, skips)
+	}
+
+	// Only keep what changed since the last successful run, if there was one
+	if opts.SinceLastRun && !f.state.LastRun.IsZero() {
+		repositories = pushedSince(repositories, f.state.LastRun, skips)
+		if !opts.Quiet && !opts.Pipeline {
+			fmt.Fprintf(opts.Out, "Processing %d repositories pushed since %s\n", len(repositories), f.state.LastRun.Format(time.RFC3339))
+		}
+	}
+	return repositories, nil
+}
+
+// runPlan is what a run sets out to do: the repositories to register under
+// their source names, the names of those to update, the recorded sources to
+// remove, and the old names of renamed repositories by new name
+type runPlan struct {
+	repositories []Repository
+	names        []string
+	changed      map[string]bool
+	removed      []string
+	renames      map[string]string
+}
+
+// planChanges names the sources of the selected repositories and, from the
+// state, works out what changed and what was renamed since the last run
+func planChanges(config *Config, opts Options, state *State, repositories []Repository) (*runPlan, error) {
+	// Catch source name collisions before anything is created
+	names, err := assignSourceNames(repositories, config.Config.DisambiguateNames)
+	if err != nil {
+		return nil, err
+	}
+	plan := &runPlan{repositories: repositories, names: names}
+
+	// Only touch what differs from the sources recorded by previous runs
+	if opts.ChangedOnly {
+		var unchanged int
+		plan.repositories, plan.names, plan.changed, plan.removed, unchanged = changesSince(state, config, repositories, names)
+		if !opts.Quiet {
+			fmt.Fprintf(opts.Out, "%d repositories unchanged since the last run\n", unchanged)
+		}
+	}
+
+	// A renamed repository updates the source of its old name rather than
+	// leaving it behind and creating another. With -pipeline, renames are not
+	// detected: that takes the whole selection, which the listing never holds.
+	if state != nil && opts.Strategy != "replace" {
+		plan.renames = state.renames(plan.repositories, plan.names)
+	}
+	for _, name := range plan.names {
+		old, found := plan.renames[name]
+		if !found {
+			continue
+		}
+		if !opts.Quiet {
+			fmt.Fprintf(opts.Out, "Detected rename %s→%s\n", old, name)
+		}
+		if plan.changed == nil {
+			plan.changed = make(map[string]bool)
+		}
+		plan.changed[name] = true
+		for i := range plan.removed {
+			if plan.removed[i] == old {
+				plan.removed = append(plan.removed[:i], plan.removed[i+1:]...)
+				break
+			}
+		}
+	}
+	return plan, nil
+}
+
+// registration is what the workers of a run share to register repositories.
+// Nothing in it changes once they start, so they read it without a lock.
+type registration struct {
+	config *Config
+	opts   Options
+	github *GitHubClient
+	sysdig *SysdigClient
+	// changed holds the names of the sources to update, and updateIDs their
+	// IDs; a changed source without an ID is gone and created again
+	changed   map[string]bool
+	updateIDs map[string]string
+	// existing holds the names of the sources Sysdig lists, which are
+	// skipped, and live their configuration to show what updates change
+	existing map[string]bool
+	live     map[string]SourceSpec
+	// hashes are those of the sources as they are, so updates that would
+	// change nothing are skipped. Sysdig's listing wins over the state.
+	hashes map[string]string
+	// recorded is a copy of the sources the state recorded, see
+	// State.recorded, as the workers record theirs as they go
+	recorded map[string]SourceSpec
+	// stamp labels the created and updated sources with the CI run
+	stamp map[string]string
+	delay time.Duration
+	// console is where workers print, under the lock they record under
+	console io.Writer
+}
+
+// newRegistration looks up what the registration of a plan needs from the
+// state and Sysdig: the IDs of the sources to update and those to remove,
+// and with idempotent the sources that already exist
+func newRegistration(ctx context.Context, config *Config, opts Options, state *State, plan *runPlan, github *GitHubClient, sysdig *SysdigClient) (*registration, []removal, error) {
+	reg := &registration{config: config, opts: opts, github: github, sysdig: sysdig, changed: plan.changed,
+		updateIDs: make(map[string]string), live: make(map[string]SourceSpec), hashes: make(map[string]string),
+		delay: time.Duration(config.Config.RequestDelayMs) * time.Millisecond}
+	if state != nil {
+		for name, source := range state.Sources {
+			reg.hashes[name] = source.Hash
+		}
+	}
+
+	// Updates and removals need the IDs of the sources
+	var removals []removal
+	if len(plan.changed) > 0 || len(plan.removed) > 0 {
+		ids, err := sourceIDs(ctx, sysdig, state, plan.changed, plan.removed, plan.renames)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fetching existing sources: %v", err)
+		}
+		for name := range plan.changed {
+			reg.updateIDs[name] = ids[name]
+		}
+		for _, name := range plan.removed {
+			removals = append(removals, removal{Name: name, Repo: state.Sources[name].Source.Repository, ID: ids[name]})
+		}
+	}
+
+	// The replace strategy starts from a clean slate: every source of the
+	// integration is deleted, then every repository is created again
+	if opts.Strategy == "replace" {
+		var err error
+		removals, err = integrationSources(ctx, sysdig, config.Config.IntegrationID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fetching existing sources: %v", err)
+		}
+	}
+
+	// Look up existing sources so they can be skipped instead of re-created.
+	// A failed lookup is only fatal in strict mode; otherwise every repository
+	// is submitted and conflicts are reported as skips.
+	// With -ignore-existing-errors, sources Sysdig lists in an error state
+	// are updated as if their configuration had changed.
+	if (config.Config.Idempotent || opts.IgnoreExistingErrors) && opts.Strategy != "replace" {
+		sources, err := getExistingSources(ctx, sysdig)
+		if err != nil {
+			if config.Config.StrictIdempotency {
+				return nil, nil, fmt.Errorf("fetching existing sources: %v", err)
+			}
+			fmt.Fprintln(opts.Out, "Warning: could not fetch existing sources, submitting all repositories:", err)
+		}
+
+		reg.existing = make(map[string]bool)
+		for name, source := range sources {
+			reg.live[name] = unstamped(config, source.spec())
+			if opts.IgnoreExistingErrors && sourceInError(source) {
+				if reg.changed == nil {
+					reg.changed = make(map[string]bool)
+				}
+				reg.changed[name] = true
+				reg.updateIDs[name] = source.ID
+				delete(reg.hashes, name)
+				continue
+			}
+			reg.existing[name] = true
+			reg.hashes[name] = reg.live[name].hash()
+		}
+	}
+
+	// Created and updated sources are stamped with the CI run. The stamp is
+	// left out of comparisons, or every source would differ from one run to
+	// the next.
+	reg.stamp = ciLabels(config)
+	if state != nil {
+		reg.recorded = state.recorded(reg.changed, plan.renames)
+	}
+	return reg, removals, nil
+}
+
+// job is a repository for the workers to register under its source name
+type job struct {
+	repo Repository
+	name string
+}
+
+// outcome is how the registration of a repository went, see register
+type outcome struct {
+	added, update, unchanged bool
+	// reason and skipCode say why a repository that is neither added nor
+	// updated is skipped
+	reason, skipCode string
+	err              error
+	// created is the source an update returned, and registered the result
+	// of a create
+	created    *Source
+	registered Result
+	changes    []string
+	// exchange is the last request made to register the repository
+	exchange *Exchange
+	// source is the source as configured, and compared the one sent without
+	// the CI stamp, see unstamped
+	source, compared SourceSpec
+	// existed, hash and updateID are those of the source when the run started
+	existed  bool
+	hash     string
+	updateID string
+	duration time.Duration
+}
+
+// register creates or updates the source of a repository, or decides to skip
+// it, without touching anything the other workers share
+func (r *registration) register(ctx context.Context, repo Repository, name string) outcome {
+	config, opts := r.config, r.opts
+	begin := time.Now()
+	o := outcome{existed: r.existing[name], hash: r.hashes[name], updateID: r.updateIDs[name]}
+
+	// Keep the last request made to register the repository
+	client := r.sysdig.recording(func(ex Exchange) { o.exchange = &ex })
+
+	// A changed source that is gone from Sysdig is created again
+	o.update = r.changed[name] && o.updateID != ""
+	o.added = !o.existed || o.update
+	o.reason, o.skipCode = "source already exists", "exists"
+
+	// Catch folders that don't exist, which would never be scanned
+	if o.added && config.Config.ValidateFolders != "" {
+		missing, err := missingFolders(ctx, r.github, repo, sourceFolders(config, repo))
+		if err != nil {
+			fmt.Fprintf(r.console, "Warning: could not check the folders of %s: %v\n", repo.Name, err)
+		} else if len(missing) > 0 && config.Config.ValidateFolders == "skip" {
+			o.added, o.update = false, false
+			o.reason, o.skipCode = "folders not found: "+strings.Join(missing, ", "), "missing-folders"
+		} else if len(missing) > 0 {
+			fmt.Fprintf(r.console, "Warning: %s has no folder %s\n", repo.Name, strings.Join(missing, ", "))
+		}
+	}
+
+	// Folder globs are resolved against the repository, but the state
+	// keeps them as configured
+	o.source = buildSource(config, repo, name)
+	payload := o.source
+	if o.added && hasGlobs(o.source.Folders) {
+		payload.Folders, o.err = expandFolders(ctx, r.github, repo, o.source.Folders)
+		if o.err == nil && len(payload.Folders) == 0 && config.Config.SkipIfNoFolders {
+			o.added, o.update = false, false
+			o.reason, o.skipCode = "no folder matches "+strings.Join(o.source.Folders, ", "), "no-folders"
+		} else if o.err == nil && len(payload.Folders) == 0 {
+			o.err = fmt.Errorf("no folder matches %s", strings.Join(o.source.Folders, ", "))
+		}
+	}
+	// Sources are compared without the CI stamp, see unstamped
+	o.compared = unstamped(config, payload)
+	o.unchanged = o.update && o.err == nil && o.hash == o.compared.hash()
+	if o.unchanged {
+		o.added, o.update = false, false
+		o.reason, o.skipCode = "source unchanged", "unchanged"
+	}
+
+	// The state holds sources as configured, before globs are expanded
+	if previous, found := r.live[name]; o.update && found {
+		o.changes = diffSources(previous, o.compared)
+	} else if previous, found := r.recorded[name]; o.update && found {
+		o.changes = diffSources(previous, o.source)
+	}
+	sent := withLabels(payload, r.stamp)
+	if o.added && o.err == nil && !opts.DryRun {
+		if o.update {
+			o.created, o.err = client.UpdateSource(ctx, o.updateID, sent)
+		} else {
+			o.registered = RegisterSource(ctx, client, config, sent)
+			o.err = o.registered.Err
+			o.added = o.registered.Action == "added"
+		}
+
+		// Hold the slot so each slot spaces out its requests
+		if r.delay > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(r.delay):
+			}
+		}
+	}
+	if o.added && o.err == nil && opts.Verify && !opts.DryRun {
+		id := o.registered.SourceID
+		if o.update {
+			id = o.updateID
+		}
+		o.err = verifySource(ctx, r.sysdig, id, sent)
+		if o.err != nil && !o.update && config.Config.RollbackOnVerifyFailure {
+			o.err = rollbackSource(ctx, r.sysdig, o.registered.SourceID, o.err)
+			o.registered.SourceID = ""
+		}
+	}
+	o.duration = time.Since(begin)
+	return o
+}
+
+// tally records the outcome of each repository in the summary, the sinks,
+// the skip audit, the state and the artifacts. The workers call it one at a
+// time.
+type tally struct {
+	summary   *Summary
+	state     *State
+	sinks     []OutputSink
+	skips     *skipReporter
+	artifacts *artifactWriter
+	progress  *progress
+	renames   map[string]string
+	out       io.Writer
+	dryRun    bool
+}
+
+// record records the outcome of registering a repository
+func (t *tally) record(repo Repository, name string, o outcome) {
+	result := Result{Repo: repo.Name, Owner: repo.Owner.Login, Changes: o.changes, Duration: o.duration}
+	if o.exchange != nil {
+		result.RequestID = o.exchange.RequestID
+		result.SysdigRequestID = o.exchange.SysdigRequestID
+		result.StatusCode = o.exchange.Status
+	}
+	if o.created != nil {
+		result.SourceID = o.created.ID
+		result.Status = o.created.Status
+	} else if o.registered.Action == "added" {
+		result.SourceID = o.registered.SourceID
+		result.Status = o.registered.Status
+	}
+	if (o.update || o.unchanged) && result.SourceID == "" {
+		result.SourceID = o.updateID
+	}
+
+	if o.err != nil {
+		t.summary.fail(&result, o.err)
+	} else if o.update {
+		result.Action = "updated"
+		t.summary.Updated++
+	} else if o.added {
+		result.Action = "added"
+		t.summary.Added++
+	} else {
+		result.Action = "skipped"
+		result.Reason = o.reason
+		t.summary.Skipped++
+		t.skips.record(repo, o.skipCode, o.reason)
+	}
+
+	t.progress.clear()
+	for _, sink := range t.sinks {
+		sink.RecordResult(result)
+	}
+	t.summary.Results = append(t.summary.Results, result)
+	if t.state != nil && o.err == nil && !t.dryRun && (o.added || o.unchanged) {
+		t.state.record(name, result.SourceID, repo.ID, o.source, o.compared.hash())
+	} else if t.state != nil && o.err == nil && !t.dryRun && o.existed {
+		t.state.record(name, result.SourceID, repo.ID, o.source, o.hash)
+	}
+	if old, renamed := t.renames[name]; renamed && o.update && o.err == nil && !t.dryRun {
+		delete(t.state.Sources, old)
+	}
+
+	if o.exchange != nil && t.artifacts != nil {
+		if err := t.artifacts.save(artifactName(repo, name), result.Action, *o.exchange); err != nil {
+			fmt.Fprintf(t.out, "Warning: could not save artifacts for %s: %v\n", repo.Name, err)
+		}
+	}
+	t.progress.increment()
+}
+
+// newRunLimit returns how many repositories are registered at once: a fixed
+// number, or with -concurrency-auto one adapted to the rate limits
+func newRunLimit(config *Config, opts Options, github *GitHubClient, sysdig *SysdigClient) *workerLimit {
+	concurrency := opts.Concurrency
+	if concurrency == 0 {
+		concurrency = config.Config.SysdigConcurrency
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if !opts.ConcurrencyAuto {
+		return newWorkerLimit(concurrency)
+	}
+
+	// Any 429 from Sysdig since the last repository, or GitHub's rate limit
+	// running low, is a signal to back off
+	var throttles int64
+	return newAdaptiveLimit(config.Config.ConcurrencyAutoMin, config.Config.ConcurrencyAutoMax, func() bool {
+		n := atomic.LoadInt64(sysdig.Throttles)
+		throttled := n > throttles
+		throttles = n
+		return throttled || github.RateLimit.low()
+	})
+}
+
+// removeSources deletes the removed sources; those already gone from Sysdig
+// are just forgotten
+func removeSources(ctx context.Context, sysdig *SysdigClient, removals []removal, state *State, sinks []OutputSink, summary *Summary, dryRun bool) {
+	for _, r := range removals {
+		result := Result{Repo: r.Repo, Action: "removed", SourceID: r.ID, removal: true}
+		var err error
+		if !dryRun && r.ID != "" {
+			err = sysdig.DeleteSource(ctx, r.ID)
+		}
+		if err != nil {
+			summary.fail(&result, err)
+		} else {
+			summary.Removed++
+			if state != nil && !dryRun {
+				delete(state.Sources, r.Name)
+			}
+		}
+		for _, sink := range sinks {
+			sink.RecordResult(result)
+		}
+		summary.Results = append(summary.Results, result)
+	}
+}
+
+// listPipeline lists the account's repositories page by page for -pipeline,
+// handing each filtered page to the workers through jobs until stop is
+// closed. taken is called for every repository handed over.
+func listPipeline(ctx context.Context, config *Config, github *GitHubClient, filter *repoFilter, jobs chan<- job, stop <-chan struct{}, taken func()) error {
+	// A single account's repositories only share names in affiliation
+	// listings of a user, and the first one listed keeps the name
+	seen := make(map[string]Repository)
+	err := github.ListRepoPages(ctx, config.Config.AccountType, config.Config.AccountName, config.Config.Team, config.Config.Affiliation, func(page []Repository) error {
+		page, err := filter.apply(ctx, page)
+		if err != nil {
+			return err
+		}
+		for _, repo := range page {
+			name := sourceName(repo.Name)
+			if other, found := seen[name]; found {
+				filter.skips.skip(repo, "name-collision", fmt.Sprintf("source name %s is already used by %s/%s", name, other.Owner.Login, other.Name))
+				continue
+			}
+			seen[name] = repo
+
+			taken()
+			select {
+			case jobs <- job{repo, name}:
+			case <-stop:
+				return errStopped
+			}
+		}
+		return nil
+	})
+	if err == errStopped {
+		return nil
+	}
+	return err
+}
+
+// attributeOrgs counts the results of each organization in its status
+func (s *Summary) attributeOrgs() {
+	for i := range s.Orgs {
+		status := &s.Orgs[i]
+		status.Added, status.Updated, status.Skipped, status.Failed = 0, 0, 0, 0
+		for _, result := range s.Results {
+			if result.removal || !strings.EqualFold(result.Owner, status.Org) {
+				continue
+			}
+			switch result.Action {
+			case "added":
+				status.Added++
+			case "updated":
+				status.Updated++
+			case "skipped":
+				status.Skipped++
+			case "failed":
+				status.Failed++
+			}
+		}
+	}
+}
+
+// finishSinks hands the summary to every sink, even after one failed, so the
+// notifications that follow a failing report still go out. The errors are
+// returned together.
+func finishSinks(sinks []OutputSink, summary Summary) error {
+	var failures []string
+	for _, sink := range sinks {
+		err := sink.Finish(summary)
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// printPayload prints the payload that would be sent for a single repository,
+// fetched from GitHub so its default branch is known, with every override
+// applied
+func printPayload(config *Config, name string) error {
+	err := config.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	github := NewGitHubClient(config.githubAPIURL(), config.Config.GithubToken)
+	repo, err := namedRepository(context.Background(), github, config, name)
+	if err != nil {
+		return err
+	}
+
+	source := buildSource(config, *repo, sourceName(repo.Name))
+	if hasGlobs(source.Folders) {
+		source.Folders, err = expandFolders(context.Background(), github, *repo, source.Folders)
+		if err != nil {
+			return err
+		}
+	}
+	payload, err := sourcePayload(config.Config.PayloadFieldMap, config.wrapInSource(), withLabels(source, ciLabels(config)))
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// namedRepository fetches a repository given as repo, of accountName, or as
+// owner/repo
+func namedRepository(ctx context.Context, github *GitHubClient, config *Config, name string) (*Repository, error) {
+	fullName := name
+	if !strings.Contains(name, "/") && config.Config.AccountName == "" {
+		return nil, fmt.Errorf("give the repository as owner/repo, accountName is not set")
+	} else if !strings.Contains(name, "/") {
+		fullName = config.Config.AccountName + "/" + name
+	}
+	repo, err := github.GetRepository(ctx, fullName)
+	if err == errGitHubNotFound {
+		return nil, fmt.Errorf("repository %s not found", fullName)
+	} else if err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", fullName, err)
+	}
+	return repo, nil
+}
+
+// hasGlobs tells whether any of the folders is a glob
+func hasGlobs(folders []string) bool {
+	for _, folder := range folders {
+		if isGlob(folder) {
+			return true
+		}
+	}
+	return false
+}
+
+// changesSince compares the repositories with the sources recorded in the
+// state. It returns the repositories that are new or whose source changed,
+// with their names, the names of the changed sources, the sources whose
+// repository is gone, and how many repositories are unchanged.
+func changesSince(state *State, config *Config, repositories []Repository, names []string) ([]Repository, []string, map[string]bool, []string, int) {
+	var kept []Repository
+	var keptNames []string
+	changed := make(map[string]bool)
+	current := make(map[string]bool)
+	unchanged := 0
+	for i, repo := range repositories {
+		name := names[i]
+		current[name] = true
+		previous, found := state.Sources[name]
+		if found && reflect.DeepEqual(previous.Source, buildSource(config, repo, name)) {
+			unchanged++
+			continue
+		} else if found {
+			changed[name] = true
+		}
+		kept = append(kept, repo)
+		keptNames = append(keptNames, name)
+	}
+
+	var removed []string
+	for name := range state.Sources {
+		if !current[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+
+	return kept, keptNames, changed, removed, unchanged
+}
+
+// removal is a source to delete
+type removal struct {
+	Name string
+	Repo string
+	ID   string
+}
+
+// integrationSources returns every source of an integration, to be removed
+func integrationSources(ctx context.Context, sysdig *SysdigClient, integrationID string) ([]removal, error) {
+	sources, err := sysdig.ListSources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var removals []removal
+	for _, source := range sources {
+		if source.IntegrationID == integrationID {
+			removals = append(removals, removal{Name: source.Name, Repo: source.Repository, ID: source.ID})
+		}
+	}
+	return removals, nil
+}
+
+// sourceIDs returns the IDs of the given sources, as recorded in the state or,
+// for those recorded without one, as listed by Sysdig. Renamed sources get the
+// ID of their old name.
+func sourceIDs(ctx context.Context, sysdig *SysdigClient, state *State, changed map[string]bool, removed []string, renames map[string]string) (map[string]string, error) {
+	ids := make(map[string]string)
+	var missing bool
+	for name := range state.Sources {
+		ids[name] = state.Sources[name].ID
+	}
+	for name, old := range renames {
+		ids[name] = ids[old]
+	}
+	for name := range changed {
+		missing = missing || ids[name] == ""
+	}
+	for _, name := range removed {
+		missing = missing || ids[name] == ""
+	}
+	if !missing {
+		return ids, nil
+	}
+
+	sources, err := sysdig.ListSources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range sources {
+		if ids[source.Name] == "" {
+			ids[source.Name] = source.ID
+		}
+	}
+	for name, old := range renames {
+		if ids[name] == "" {
+			ids[name] = ids[old]
+		}
+	}
+	return ids, nil
+}
+
+// printResult prints the line of a processed repository, using the
+// messageFormat templates when they are set. Quiet runs only print failures.
+func printResult(messages *messageTemplates, result Result, opts Options) {
+	msg := message{Repo: result.Repo, Owner: result.Owner, Action: result.Action, SourceID: result.SourceID, Status: result.Status, Error: result.Error, Reason: result.Reason, RequestID: result.RequestID}
+	if msg.Action == "failed" && result.removal {
+		fmt.Fprintf(opts.Out, "Failed to remove %s: %s\n", msg.Repo, msg.Error)
+		return
+	} else if msg.Action == "failed" {
+		if !messages.print(opts.Out, messages.failure, msg) {
+			fmt.Fprintf(opts.Out, "Failed to add %s: %s%s\n", msg.Repo, msg.Error, requestSuffix(result))
+		}
+		return
+	} else if opts.Quiet {
+		return
+	}
+
+	if msg.Action == "removed" && opts.DryRun {
+		fmt.Fprintf(opts.Out, "Would remove %s\n", msg.Repo)
+		return
+	} else if msg.Action == "removed" {
+		fmt.Fprintf(opts.Out, "Removed %s\n", msg.Repo)
+		return
+	}
+
+	if msg.Action == "skipped" {
+		if !messages.print(opts.Out, messages.skip, msg) {
+			fmt.Fprintf(opts.Out, "Skipping %s: %s\n", msg.Repo, msg.Reason)
+		}
+		return
+	} else if messages.print(opts.Out, messages.success, msg) {
+		return
+	}
+
+	if msg.Action == "updated" && opts.DryRun {
+		fmt.Fprintf(opts.Out, "Would update %s\n", msg.Repo)
+		printChanges(opts.Out, result.Changes)
+	} else if msg.Action == "updated" {
+		fmt.Fprintf(opts.Out, "Updated %s\n", msg.Repo)
+		printChanges(opts.Out, result.Changes)
+	} else if opts.DryRun {
+		fmt.Fprintf(opts.Out, "Would add %s\n", msg.Repo)
+	} else if msg.SourceID != "" {
+		fmt.Fprintf(opts.Out, "Successfully added %s (id %s%s)\n", msg.Repo, msg.SourceID, statusSuffix(msg.Status))
+	} else {
+		fmt.Fprintf(opts.Out, "Successfully added %s\n", msg.Repo)
+	}
+}
+
+// printChanges lists the fields an update changes under its line
+func printChanges(out io.Writer, changes []string) {
+	for _, change := range changes {
+		fmt.Fprintf(out, "    %s\n", change)
+	}
+}
+
+// requestSuffix formats the request IDs of a result, to quote to Sysdig
+// support
+func requestSuffix(result Result) string {
+	if result.RequestID == "" {
+		return ""
+	} else if result.SysdigRequestID != "" && result.SysdigRequestID != result.RequestID {
+		return fmt.Sprintf(" (request %s, Sysdig request %s)", result.RequestID, result.SysdigRequestID)
+	}
+	return fmt.Sprintf(" (request %s)", result.RequestID)
+}
+
+// statusSuffix formats the status Sysdig reported for a new source, if any
+func statusSuffix(status string) string {
+	if status == "" {
+		return ""
+	}
+	return ", status " + status
+}
+
+// sortRepositories orders repositories for processing. Names are compared
+// case-insensitively and ties keep the order GitHub returned.
+func sortRepositories(repositories []Repository, order string) {
+	sort.SliceStable(repositories, func(i, j int) bool {
+		a, b := repositories[i], repositories[j]
+		switch order {
+		case "name-desc":
+			return strings.ToLower(a.Name) > strings.ToLower(b.Name)
+		case "updated-desc":
+			return a.UpdatedAt.After(b.UpdatedAt)
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+}
+
+// withoutDescriptionMatching removes the repositories whose description
+// matches the pattern, such as a "[no-scan]" marker
+func withoutDescriptionMatching(repositories []Repository, pattern *regexp.Regexp, skips *skipReporter) []Repository {
+	var kept []Repository
+	for _, repo := range repositories {
+		if pattern.MatchString(repo.Description) {
+			skips.skip(repo, "description", "description matches descriptionExcludePattern")
+			continue
+		}
+		kept = append(kept, repo)
+	}
+	return kept
+}
+
+// readRepositories reads repository names, one per line, such as the output
+// of "gh repo list". Blank lines and # comments are skipped, and "owner/repo"
+// names keep their owner; the others belong to the default owner.
+func readRepositories(in io.Reader, owner string) ([]Repository, error) {
+	repositories := []Repository{}
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// gh prints more columns after the name
+		fields := strings.Fields(line)
+		var repo Repository
+		repo.Owner.Login = owner
+		repo.Name = fields[0]
+		if i := strings.LastIndex(repo.Name, "/"); i >= 0 {
+			repo.Owner.Login = repo.Name[:i]
+			repo.Name = repo.Name[i+1:]
+		}
+		repo.FullName = repo.Owner.Login + "/" + repo.Name
+		repositories = append(repositories, repo)
+	}
+	return repositories, scanner.Err()
+}
+
+// failedInReport returns the names of the repositories that failed in a JSON
+// report written by -report
+func failedInReport(filename string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var report Summary
+	err = json.Unmarshal(data, &report)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	failed := make(map[string]bool)
+	for _, repo := range report.FailedRepos {
+		failed[repo] = true
+	}
+	return failed, nil
+}
+
+// onlyRepositories keeps the repositories with the given names
+func onlyRepositories(repositories []Repository, names map[string]bool) []Repository {
+	var kept []Repository
+	for _, repo := range repositories {
+		if names[repo.Name] {
+			kept = append(kept, repo)
+		}
+	}
+	return kept
+}
+
+// uniqueOrgs returns the account followed by the other organizations, without
+// duplicates
+func uniqueOrgs(accountName string, orgs []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, org := range append([]string{accountName}, orgs...) {
+		if org != "" && !seen[strings.ToLower(org)] {
+			seen[strings.ToLower(org)] = true
+			unique = append(unique, org)
+		}
+	}
+	return unique
+}
+
+// withoutDisabled removes the repositories GitHub has disabled, which can't
+// be scanned
+func withoutDisabled(repositories []Repository, skips *skipReporter) []Repository {
+	var kept []Repository
+	for _, repo := range repositories {
+		if repo.Disabled {
+			skips.skip(repo, "disabled", "repository is disabled")
+			continue
+		}
+		kept = append(kept, repo)
+	}
+	return kept
+}
+
+// withoutArchived removes the archived repositories, which are read-only
+func withoutArchived(repositories []Repository, skips *skipReporter) []Repository {
+	var kept []Repository
+	for _, repo := range repositories {
+		if repo.Archived {
+			skips.skip(repo, "archived", "repository is archived")
+			continue
+		}
+		kept = append(kept, repo)
+	}
+	return kept
+}
+
+// withoutTemplates removes the template repositories, which only seed other
+// repositories
+func withoutTemplates(repositories []Repository, skips *skipReporter) []Repository {
+	var kept []Repository
+	for _, repo := range repositories {
+		if repo.IsTemplate {
+			skips.skip(repo, "template", "repository is a template")
+			continue
+		}
+		kept = append(kept, repo)
+	}
+	return kept
+}
+
+// withOwners keeps the repositories whose owner is allowed, when allow is not
+// empty, and not denied. Logins are compared case insensitively.
+func withOwners(repositories []Repository, allow, deny []string, skips *skipReporter) []Repository {
+	contains := func(logins []string, login string) bool {
+		for _, l := range logins {
+			if strings.EqualFold(l, login) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var kept []Repository
+	for _, repo := range repositories {
+		if len(allow) > 0 && !contains(allow, repo.Owner.Login) {
+			skips.skip(repo, "owner", fmt.Sprintf("owner %s is not in allowOwners", repo.Owner.Login))
+		} else if contains(deny, repo.Owner.Login) {
+			skips.skip(repo, "owner", fmt.Sprintf("owner %s is in denyOwners", repo.Owner.Login))
+		} else {
+			kept = append(kept, repo)
+		}
+	}
+	return kept
+}
+
+// withMinStars removes the repositories with fewer than min stars
+func withMinStars(repositories []Repository, min int, skips *skipReporter) []Repository {
+	var kept []Repository
+	for _, repo := range repositories {
+		if repo.Stars < min {
+			skips.skip(repo, "min-stars", fmt.Sprintf("%d stars, fewer than minStars", repo.Stars))
+			continue
+		}
+		kept = append(kept, repo)
+	}
+	return kept
+}
+
+// withWriteAccess removes the repositories the token can't push to. Those
+// GitHub gave no permissions for are kept
+func withWriteAccess(repositories []Repository, skips *skipReporter) []Repository {
+	var kept []Repository
+	for _, repo := range repositories {
+		if repo.Permissions != nil && !repo.Permissions.Push {
+			skips.skip(repo, "read-only", "the github token has no write access, which Sysdig needs to post PR checks")
+			continue
+		}
+		kept = append(kept, repo)
+	}
+	return kept
+}
+
+// withVisibility keeps the repositories with the given visibility
+func withVisibility(repositories []Repository, visibility string, skips *skipReporter) []Repository {
+	var kept []Repository
+	for _, repo := range repositories {
+		if repo.visibility() != visibility {
+			skips.skip(repo, "visibility", fmt.Sprintf("%s repository, only %s ones are onboarded", repo.visibility(), visibility))
+			continue
+		}
+		kept = append(kept, repo)
+	}
+	return kept
+}
+
+// pushedSince keeps the repositories pushed after the given time
+func pushedSince(repositories []Repository, since time.Time, skips *skipReporter) []Repository {
+	var recent []Repository
+	for _, repo := range repositories {
+		if repo.PushedAt.After(since) {
+			recent = append(recent, repo)
+		} else {
+			skips.record(repo, "not-pushed", "not pushed since the last run")
+		}
+	}
+	return recent
+}
+
+// assignSourceNames returns the source name of each repository. Repositories
+// of different owners can share a name; such collisions are an error unless
+// disambiguate is set, in which case the owner is appended to those names.
+func assignSourceNames(repositories []Repository, disambiguate bool) ([]string, error) {
+	byName := make(map[string][]int)
+	names := make([]string, len(repositories))
+	for i, repo := range repositories {
+		names[i] = sourceName(repo.Name)
+		byName[names[i]] = append(byName[names[i]], i)
+	}
+
+	var collisions []string
+	for name, indexes := range byName {
+		if len(indexes) < 2 {
+			continue
+		}
+
+		var owners []string
+		for _, i := range indexes {
+			owners = append(owners, repositories[i].Owner.Login+"/"+repositories[i].Name)
+			names[i] = name + "_" + repositories[i].Owner.Login
+		}
+		collisions = append(collisions, fmt.Sprintf("%s (%s)", name, strings.Join(owners, ", ")))
+	}
+
+	if len(collisions) > 0 && !disambiguate {
+		sort.Strings(collisions)
+		return nil, fmt.Errorf("duplicate source names: %s", strings.Join(collisions, "; "))
+	}
+
+	return names, nil
+}
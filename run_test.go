@@ -0,0 +1,816 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newGitHubServer serves a fixed organization repository listing
+func newGitHubServer(t *testing.T, org string, repos []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/orgs/"+org+"/repos" {
+			t.Errorf("unexpected GitHub request: %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "token gh-token" {
+			t.Errorf("GitHub Authorization = %q", got)
+		}
+
+		var list []Repository
+		for _, name := range repos {
+			list = append(list, Repository{Name: name})
+		}
+		json.NewEncoder(w).Encode(list)
+	}))
+}
+
+// sysdigRecorder is a fake Sysdig API that records every created source
+type sysdigRecorder struct {
+	mu       sync.Mutex
+	payloads []map[string]interface{}
+}
+
+func (s *sysdigRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/api/cspm/v1/gitProvider/gitSources" {
+		http.NotFound(w, r)
+		return
+	}
+	if got := r.Header.Get("Authorization"); got != "Bearer secure-token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var payload map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.payloads = append(s.payloads, payload)
+	s.mu.Unlock()
+	w.Write([]byte(`{}`))
+}
+
+// fakeSysdig is a Sysdig API holding sources, which records the method and
+// source ID of every request, such as "PUT src-1"
+type fakeSysdig struct {
+	mu       sync.Mutex
+	sources  []Source
+	requests []string
+	created  int
+}
+
+func (s *fakeSysdig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/cspm/v1/gitProvider/gitSources"), "/")
+	s.requests = append(s.requests, strings.TrimSpace(r.Method+" "+id))
+
+	var payload SourcePayload
+	if r.Method == "POST" || r.Method == "PUT" {
+		json.NewDecoder(r.Body).Decode(&payload)
+	}
+	spec := payload.Source
+	source := Source{Name: spec.Name, Repository: spec.Repository, Folders: spec.Folders, PRScanBranchPattern: spec.PRScanBranchPattern,
+		IntegrationID: spec.IntegrationID, Labels: spec.Labels, ScanSchedule: spec.ScanSchedule, ScanTriggers: spec.ScanTriggers}
+	switch {
+	case r.Method == "GET" && id == "":
+		json.NewEncoder(w).Encode(map[string]interface{}{"sources": s.sources})
+		return
+	case r.Method == "POST":
+		s.created++
+		source.ID = fmt.Sprintf("new-%d", s.created)
+		s.sources = append(s.sources, source)
+		json.NewEncoder(w).Encode(source)
+		return
+	}
+	for i := range s.sources {
+		if s.sources[i].ID != id {
+			continue
+		}
+		switch r.Method {
+		case "GET":
+			json.NewEncoder(w).Encode(s.sources[i])
+		case "PUT":
+			source.ID = id
+			s.sources[i] = source
+			json.NewEncoder(w).Encode(source)
+		case "DELETE":
+			s.sources = append(s.sources[:i], s.sources[i+1:]...)
+			w.Write([]byte(`{}`))
+		}
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// sorted returns the requests in order, as workers send them concurrently
+func (s *fakeSysdig) sorted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := append([]string(nil), s.requests...)
+	sort.Strings(requests)
+	return requests
+}
+
+func newTestConfig(githubURL, sysdigURL string) *Config {
+	var config Config
+	config.Config.GithubAPIURL = githubURL
+	config.Config.GithubToken = "gh-token"
+	config.Config.SecureURL = sysdigURL
+	config.Config.SecureAPIToken = "secure-token"
+	config.Config.AccountType = "org"
+	config.Config.AccountName = "acme"
+	config.Config.IntegrationID = "integration-1"
+	config.Config.PRScanBranchPattern = "main"
+	config.Config.Folders = []string{"/", "/infra"}
+	return &config
+}
+
+func TestRunRegistersEveryRepository(t *testing.T) {
+	github := newGitHubServer(t, "acme", []string{"alpha", "beta"})
+	defer github.Close()
+	recorder := &sysdigRecorder{}
+	sysdig := httptest.NewServer(recorder)
+	defer sysdig.Close()
+
+	summary, err := run(newTestConfig(github.URL, sysdig.URL), Options{Yes: true})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if summary.Added != 2 || summary.Failed != 0 {
+		t.Errorf("summary = %+v", summary)
+	}
+	for _, result := range summary.Results {
+		if result.Action != "added" || result.StatusCode != http.StatusOK || result.Err != nil || result.Duration <= 0 {
+			t.Errorf("result = %+v", result)
+		}
+	}
+
+	var want []map[string]interface{}
+	for _, repo := range []string{"alpha", "beta"} {
+		want = append(want, map[string]interface{}{
+			"source": map[string]interface{}{
+				"repository":          repo,
+				"folders":             []interface{}{"/", "/infra"},
+				"prScanBranchPattern": "main",
+				"integrationId":       "integration-1",
+				"name":                repo + "_source",
+			},
+		})
+	}
+	if !reflect.DeepEqual(recorder.payloads, want) {
+		t.Errorf("payloads = %v, want %v", recorder.payloads, want)
+	}
+}
+
+func TestRunDryRunDoesNotPost(t *testing.T) {
+	github := newGitHubServer(t, "acme", []string{"alpha", "beta"})
+	defer github.Close()
+	recorder := &sysdigRecorder{}
+	sysdig := httptest.NewServer(recorder)
+	defer sysdig.Close()
+
+	summary, err := run(newTestConfig(github.URL, sysdig.URL), Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if summary.Added != 2 {
+		t.Errorf("summary = %+v", summary)
+	}
+	if len(recorder.payloads) != 0 {
+		t.Errorf("dry run posted %d payloads", len(recorder.payloads))
+	}
+}
+
+func TestRunPipelineKeepsListedPages(t *testing.T) {
+	// The second page fails, after the first was handed to the workers
+	var github *httptest.Server
+	github = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			http.Error(w, "boom", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Link", "<"+github.URL+r.URL.Path+"?per_page=100&page=2>; rel=\"next\"")
+		json.NewEncoder(w).Encode([]Repository{{Name: "alpha"}, {Name: "beta"}})
+	}))
+	defer github.Close()
+	recorder := &sysdigRecorder{}
+	sysdig := httptest.NewServer(recorder)
+	defer sysdig.Close()
+
+	summary, err := run(newTestConfig(github.URL, sysdig.URL), Options{Yes: true, Pipeline: true})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if summary.Total != 2 || summary.Added != 2 || len(recorder.payloads) != 2 {
+		t.Errorf("summary = %+v, %d payloads", summary, len(recorder.payloads))
+	}
+	if code := exitCode(summary); code != exitPartialListing {
+		t.Errorf("exit code = %d, want %d", code, exitPartialListing)
+	}
+}
+
+func TestRunStampsCILabels(t *testing.T) {
+	t.Setenv("GITHUB_SHA", "")
+	t.Setenv("CI_COMMIT_SHA", "abc123")
+	github := newGitHubServer(t, "acme", []string{"alpha"})
+	defer github.Close()
+	recorder := &sysdigRecorder{}
+	sysdig := httptest.NewServer(recorder)
+	defer sysdig.Close()
+
+	config := newTestConfig(github.URL, sysdig.URL)
+	config.Config.Labels = map[string]string{"team": "platform"}
+	config.Config.CILabels = map[string][]string{"commitSha": {"GITHUB_SHA", "CI_COMMIT_SHA"}, "pipelineId": {"CI_PIPELINE_ID_UNSET"}}
+	if _, err := run(config, Options{Yes: true}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	source := recorder.payloads[0]["source"].(map[string]interface{})
+	want := map[string]interface{}{"team": "platform", "commitSha": "abc123"}
+	if !reflect.DeepEqual(source["labels"], want) {
+		t.Errorf("labels = %v, want %v", source["labels"], want)
+	}
+	if !reflect.DeepEqual(config.Config.Labels, map[string]string{"team": "platform"}) {
+		t.Errorf("configured labels changed to %v", config.Config.Labels)
+	}
+}
+
+func TestRunRollsBackUnverifiedSource(t *testing.T) {
+	github := newGitHubServer(t, "acme", []string{"alpha"})
+	defer github.Close()
+
+	// Sysdig keeps the created source with another repository
+	var mu sync.Mutex
+	var created []Source
+	var deleted []string
+	sysdig := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "POST":
+			var payload SourcePayload
+			json.NewDecoder(r.Body).Decode(&payload)
+			source := Source{ID: "src-1", Name: payload.Source.Name, Repository: "elsewhere"}
+			created = append(created, source)
+			json.NewEncoder(w).Encode(source)
+		case "GET":
+			if r.URL.Path != "/api/cspm/v1/gitProvider/gitSources/src-1" || len(created) != 1 {
+				t.Errorf("unexpected Sysdig request: %s %s", r.Method, r.URL.Path)
+			}
+			json.NewEncoder(w).Encode(created[0])
+		case "DELETE":
+			deleted = append(deleted, r.URL.Path)
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer sysdig.Close()
+
+	config := newTestConfig(github.URL, sysdig.URL)
+	config.Config.RollbackOnVerifyFailure = true
+	summary, err := run(config, Options{Yes: true, Verify: true})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if summary.Failed != 1 || summary.Added != 0 {
+		t.Errorf("summary = %+v", summary)
+	}
+	if want := []string{"/api/cspm/v1/gitProvider/gitSources/src-1"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted = %v, want %v", deleted, want)
+	}
+	if result := summary.Results[0]; result.SourceID != "" || !strings.Contains(result.Error, "rolled back") {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+func TestRunComparesStampedSourcesWithoutTheStamp(t *testing.T) {
+	t.Setenv("GITHUB_SHA", "new-sha")
+	tests := []struct {
+		name    string
+		folders []string
+		wantPut bool
+	}{
+		{"unchanged", []string{"/", "/infra"}, false},
+		{"changed", []string{"/"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			github := newGitHubServer(t, "acme", []string{"alpha"})
+			defer github.Close()
+
+			// Sysdig lists the source as stamped by an earlier CI run
+			var listed Source
+			var puts []SourcePayload
+			sysdig := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.Method {
+				case "GET":
+					json.NewEncoder(w).Encode(map[string]interface{}{"sources": []Source{listed}})
+				case "PUT":
+					var payload SourcePayload
+					json.NewDecoder(r.Body).Decode(&payload)
+					puts = append(puts, payload)
+					w.Write([]byte(`{}`))
+				default:
+					t.Errorf("unexpected Sysdig request: %s %s", r.Method, r.URL.Path)
+				}
+			}))
+			defer sysdig.Close()
+
+			config := newTestConfig(github.URL, sysdig.URL)
+			config.Config.Idempotent = true
+			config.Config.CILabels = map[string][]string{"commitSha": {"GITHUB_SHA"}}
+			config.Config.StateFile = filepath.Join(t.TempDir(), "state.json")
+			names, _ := assignSourceNames([]Repository{{Name: "alpha"}}, false)
+			spec := buildSource(config, Repository{Name: "alpha"}, names[0])
+			listed = Source{ID: "src-1", Name: spec.Name, Repository: spec.Repository, Folders: tt.folders,
+				PRScanBranchPattern: spec.PRScanBranchPattern, IntegrationID: spec.IntegrationID,
+				Labels: map[string]string{"commitSha": "old-sha"}}
+			state := &State{Sources: map[string]StateSource{spec.Name: {ID: "src-1", Source: SourceSpec{Repository: "alpha"}}}}
+			if err := state.save(config.Config.StateFile); err != nil {
+				t.Fatal(err)
+			}
+
+			summary, err := run(config, Options{Yes: true, ChangedOnly: true})
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if !tt.wantPut {
+				if len(puts) != 0 || summary.Skipped != 1 {
+					t.Errorf("summary = %+v, %d updates", summary, len(puts))
+				}
+				return
+			}
+			if len(puts) != 1 || puts[0].Source.Labels["commitSha"] != "new-sha" {
+				t.Fatalf("updates = %+v", puts)
+			}
+			for _, change := range summary.Results[0].Changes {
+				if strings.Contains(change, "commitSha") {
+					t.Errorf("changes = %v", summary.Results[0].Changes)
+				}
+			}
+		})
+	}
+}
+
+func TestRunMaxReposHoldsWithoutTerminal(t *testing.T) {
+	github := newGitHubServer(t, "acme", []string{"alpha", "beta"})
+	defer github.Close()
+	recorder := &sysdigRecorder{}
+	sysdig := httptest.NewServer(recorder)
+	defer sysdig.Close()
+
+	// Tests don't run from a terminal, so -yes cannot waive the cap
+	config := newTestConfig(github.URL, sysdig.URL)
+	config.Config.MaxRepos = 1
+	_, err := run(config, Options{Yes: true})
+	if err == nil || !strings.Contains(err.Error(), "raise maxRepos") {
+		t.Errorf("run error = %v", err)
+	}
+	if len(recorder.payloads) != 0 {
+		t.Errorf("%d sources created", len(recorder.payloads))
+	}
+
+	config.Config.MaxRepos = 2
+	if _, err := run(config, Options{Yes: true}); err != nil {
+		t.Errorf("run within maxRepos: %v", err)
+	}
+}
+
+func TestRunPrintsToOut(t *testing.T) {
+	github := newGitHubServer(t, "acme", []string{"alpha"})
+	defer github.Close()
+	sysdig := httptest.NewServer(&sysdigRecorder{})
+	defer sysdig.Close()
+
+	var out bytes.Buffer
+	if _, err := run(newTestConfig(github.URL, sysdig.URL), Options{Yes: true, Out: &out}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if !strings.Contains(out.String(), "Successfully added alpha") || !strings.Contains(out.String(), "Processed 1 repositories") {
+		t.Errorf("output = %q", out.String())
+	}
+}
+
+func TestRunKeepsArtifactsOfNamesakesApart(t *testing.T) {
+	github := newGitHubServer(t, "acme", nil)
+	defer github.Close()
+	sysdig := httptest.NewServer(&sysdigRecorder{})
+	defer sysdig.Close()
+
+	var repos []Repository
+	for _, owner := range []string{"acme", "widgets"} {
+		repo := Repository{Name: "api"}
+		repo.Owner.Login = owner
+		repos = append(repos, repo)
+	}
+	config := newTestConfig(github.URL, sysdig.URL)
+	config.Config.DisambiguateNames = true
+	dir := t.TempDir()
+	if _, err := run(config, Options{Yes: true, Repos: repos, OutDir: dir}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.request.json"))
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	if want := []string{"api_acme.request.json", "api_widgets.request.json"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("artifacts = %v, want %v", files, want)
+	}
+}
+
+func TestRunAnnotatesFilteredRepositories(t *testing.T) {
+	github := newGitHubServer(t, "acme", nil)
+	defer github.Close()
+	sysdig := httptest.NewServer(&sysdigRecorder{})
+	defer sysdig.Close()
+
+	repos := []Repository{{Name: "alpha"}, {Name: "beta", IsTemplate: true}}
+	var annotations bytes.Buffer
+	opts := Options{Yes: true, Repos: repos, Out: ioutil.Discard, Sinks: []OutputSink{&annotationSink{out: &annotations}}}
+	if _, err := run(newTestConfig(github.URL, sysdig.URL), opts); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if want := "::warning::Skipped beta: repository is a template\n"; annotations.String() != want {
+		t.Errorf("annotations = %q, want %q", annotations.String(), want)
+	}
+}
+
+func TestRunChangedOnlyAppliesDeltas(t *testing.T) {
+	github := newGitHubServer(t, "acme", []string{"kept", "edited", "added"})
+	defer github.Close()
+	sysdig := &fakeSysdig{sources: []Source{{ID: "src-1"}, {ID: "src-2"}, {ID: "src-3"}}}
+	server := httptest.NewServer(sysdig)
+	defer server.Close()
+
+	config := newTestConfig(github.URL, server.URL)
+	config.Config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	kept := buildSource(config, Repository{Name: "kept"}, sourceName("kept"))
+	edited := buildSource(config, Repository{Name: "edited"}, sourceName("edited"))
+	edited.Folders = []string{"/old"}
+	state := &State{Sources: map[string]StateSource{
+		kept.Name:          {ID: "src-1", Source: kept, Hash: kept.hash()},
+		edited.Name:        {ID: "src-2", Source: edited, Hash: edited.hash()},
+		sourceName("gone"): {ID: "src-3", Source: SourceSpec{Repository: "gone"}},
+	}}
+	if err := state.save(config.Config.StateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := run(config, Options{Yes: true, ChangedOnly: true, Out: ioutil.Discard})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if want := []string{"DELETE src-3", "POST", "PUT src-2"}; !reflect.DeepEqual(sysdig.sorted(), want) {
+		t.Errorf("requests = %v, want %v", sysdig.sorted(), want)
+	}
+	if summary.Added != 1 || summary.Updated != 1 || summary.Removed != 1 || summary.Failed != 0 {
+		t.Errorf("summary = %+v", summary)
+	}
+
+	// The state now matches, so a second run has nothing to do
+	sysdig.requests = nil
+	if _, err := run(config, Options{Yes: true, ChangedOnly: true, Out: ioutil.Discard}); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if len(sysdig.requests) != 0 {
+		t.Errorf("second run requests = %v", sysdig.requests)
+	}
+}
+
+func TestRunReplaceStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		dryRun   bool
+		requests []string
+	}{
+		{"apply", false, []string{"DELETE src-1", "GET", "POST", "POST"}},
+		{"dry run", true, []string{"GET"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			github := newGitHubServer(t, "acme", []string{"alpha", "beta"})
+			defer github.Close()
+			// Only the sources of the configured integration are replaced
+			sysdig := &fakeSysdig{sources: []Source{
+				{ID: "src-1", Name: sourceName("alpha"), IntegrationID: "integration-1"},
+				{ID: "src-2", Name: sourceName("other"), IntegrationID: "integration-2"},
+			}}
+			server := httptest.NewServer(sysdig)
+			defer server.Close()
+
+			opts := Options{Yes: true, Strategy: "replace", DryRun: test.dryRun, Out: ioutil.Discard}
+			summary, err := run(newTestConfig(github.URL, server.URL), opts)
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if !reflect.DeepEqual(sysdig.sorted(), test.requests) {
+				t.Errorf("requests = %v, want %v", sysdig.sorted(), test.requests)
+			}
+			if summary.Removed != 1 || summary.Added != 2 || summary.Failed != 0 {
+				t.Errorf("summary = %+v", summary)
+			}
+		})
+	}
+}
+
+func TestRunSkipsUpdatesThatChangeNothing(t *testing.T) {
+	tests := []struct {
+		name     string
+		sameHash bool
+		requests []string
+		skipped  int
+	}{
+		{"same payload", true, nil, 1},
+		{"other payload", false, []string{"PUT src-1"}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			github := newGitHubServer(t, "acme", []string{"alpha"})
+			defer github.Close()
+			sysdig := &fakeSysdig{sources: []Source{{ID: "src-1"}}}
+			server := httptest.NewServer(sysdig)
+			defer server.Close()
+
+			// The state's configuration differs, so the source is a
+			// candidate for an update, but its hash decides
+			config := newTestConfig(github.URL, server.URL)
+			config.Config.StateFile = filepath.Join(t.TempDir(), "state.json")
+			desired := buildSource(config, Repository{Name: "alpha"}, sourceName("alpha"))
+			recorded := StateSource{ID: "src-1", Source: SourceSpec{Repository: "alpha"}, Hash: "other"}
+			if test.sameHash {
+				recorded.Hash = desired.hash()
+			}
+			state := &State{Sources: map[string]StateSource{desired.Name: recorded}}
+			if err := state.save(config.Config.StateFile); err != nil {
+				t.Fatal(err)
+			}
+
+			summary, err := run(config, Options{Yes: true, ChangedOnly: true, Out: ioutil.Discard})
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if !reflect.DeepEqual(sysdig.sorted(), test.requests) {
+				t.Errorf("requests = %v, want %v", sysdig.sorted(), test.requests)
+			}
+			if summary.Skipped != test.skipped || summary.Failed != 0 {
+				t.Errorf("summary = %+v", summary)
+			}
+		})
+	}
+}
+
+func TestRunUpdatesRenamedRepositories(t *testing.T) {
+	tests := []struct {
+		name     string
+		repoID   int64
+		requests []string
+		sources  []string
+		changes  bool
+	}{
+		{"same repository", 42, []string{"PUT src-1"}, []string{"beta_source"}, true},
+		{"other repository", 7, []string{"POST"}, []string{"alpha_source", "beta_source"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sysdig := &fakeSysdig{sources: []Source{{ID: "src-1"}}}
+			server := httptest.NewServer(sysdig)
+			defer server.Close()
+
+			// alpha was recorded under GitHub ID 42, then beta shows up
+			config := newTestConfig("http://github.invalid", server.URL)
+			config.Config.StateFile = filepath.Join(t.TempDir(), "state.json")
+			old := buildSource(config, Repository{Name: "alpha"}, sourceName("alpha"))
+			state := &State{Sources: map[string]StateSource{
+				old.Name: {ID: "src-1", RepoID: 42, Source: old, Hash: old.hash()},
+			}}
+			if err := state.save(config.Config.StateFile); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := Options{Yes: true, Repos: []Repository{{Name: "beta", ID: test.repoID}}, Out: ioutil.Discard}
+			summary, err := run(config, opts)
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if !reflect.DeepEqual(sysdig.sorted(), test.requests) {
+				t.Errorf("requests = %v, want %v", sysdig.sorted(), test.requests)
+			}
+			if summary.Failed != 0 {
+				t.Errorf("summary = %+v", summary)
+			}
+			// The update is described against the source of the old name
+			if changes := summary.Results[0].Changes; (len(changes) > 0) != test.changes {
+				t.Errorf("changes = %v", changes)
+			}
+
+			saved, err := loadState(config.Config.StateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sources []string
+			for name := range saved.Sources {
+				sources = append(sources, name)
+			}
+			sort.Strings(sources)
+			if !reflect.DeepEqual(sources, test.sources) {
+				t.Errorf("state sources = %v, want %v", sources, test.sources)
+			}
+		})
+	}
+}
+
+func TestRunSkipIfNoFolders(t *testing.T) {
+	tests := []struct {
+		name     string
+		folders  []string
+		skip     bool
+		requests []string
+		skipped  int
+		failed   int
+	}{
+		{"glob matches", []string{"modules/*"}, false, []string{"POST"}, 0, 0},
+		{"no match", []string{"services/*"}, false, nil, 0, 1},
+		{"no match skipped", []string{"services/*"}, true, nil, 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/orgs/acme/repos":
+					w.Write([]byte(`[{"name": "alpha", "owner": {"login": "acme"}}]`))
+				case "/repos/acme/alpha/git/trees/HEAD":
+					w.Write([]byte(`{"tree": [{"path": "modules", "type": "tree"}, {"path": "modules/vpc", "type": "tree"}]}`))
+				default:
+					t.Errorf("unexpected GitHub request: %s %s", r.Method, r.URL.Path)
+					http.NotFound(w, r)
+				}
+			}))
+			defer github.Close()
+			sysdig := &fakeSysdig{}
+			server := httptest.NewServer(sysdig)
+			defer server.Close()
+
+			config := newTestConfig(github.URL, server.URL)
+			config.Config.Folders = test.folders
+			config.Config.SkipIfNoFolders = test.skip
+			summary, err := run(config, Options{Yes: true, Out: ioutil.Discard})
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if !reflect.DeepEqual(sysdig.sorted(), test.requests) {
+				t.Errorf("requests = %v, want %v", sysdig.sorted(), test.requests)
+			}
+			if summary.Skipped != test.skipped || summary.Failed != test.failed {
+				t.Errorf("summary = %+v", summary)
+			}
+		})
+	}
+}
+
+func TestRunChangedOnlyUpdatesConcurrently(t *testing.T) {
+	var names []string
+	for i := 0; i < 40; i++ {
+		names = append(names, fmt.Sprintf("repo%02d", i))
+	}
+	github := newGitHubServer(t, "acme", names)
+	defer github.Close()
+	sysdig := &fakeSysdig{}
+	server := httptest.NewServer(sysdig)
+	defer server.Close()
+
+	// Every worker reads the recorded source of its repository while the
+	// others record theirs, which go test -race checks
+	config := newTestConfig(github.URL, server.URL)
+	config.Config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	config.Config.SysdigConcurrency = 8
+	state := &State{Sources: make(map[string]StateSource)}
+	for i, name := range names {
+		id := fmt.Sprintf("src-%d", i)
+		recorded := buildSource(config, Repository{Name: name}, sourceName(name))
+		recorded.Folders = []string{"/old"}
+		state.Sources[recorded.Name] = StateSource{ID: id, Source: recorded, Hash: recorded.hash()}
+		sysdig.sources = append(sysdig.sources, Source{ID: id})
+	}
+	if err := state.save(config.Config.StateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := run(config, Options{Yes: true, ChangedOnly: true, Out: ioutil.Discard})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if summary.Updated != len(names) || summary.Failed != 0 {
+		t.Errorf("summary = %+v", summary)
+	}
+	for _, result := range summary.Results {
+		if want := []string{"folders: +/ +/infra -/old"}; !reflect.DeepEqual(result.Changes, want) {
+			t.Errorf("%s changes = %v, want %v", result.Repo, result.Changes, want)
+		}
+	}
+}
+
+func TestRunPipelinePrintsSkipsWithTheWorkers(t *testing.T) {
+	// The second page is filtered while the workers print the first
+	var github *httptest.Server
+	github = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var page []Repository
+		for i := 0; i < 10; i++ {
+			page = append(page, Repository{Name: fmt.Sprintf("repo%s-%d", r.URL.Query().Get("page"), i)})
+		}
+		if r.URL.Query().Get("page") == "2" {
+			for i := range page {
+				page[i].Disabled = true
+			}
+		} else {
+			w.Header().Set("Link", "<"+github.URL+r.URL.Path+"?per_page=100&page=2>; rel=\"next\"")
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer github.Close()
+	sysdig := httptest.NewServer(&sysdigRecorder{})
+	defer sysdig.Close()
+
+	// go test -race catches writes to out that don't take the lock
+	var out bytes.Buffer
+	summary, err := run(newTestConfig(github.URL, sysdig.URL), Options{Yes: true, Pipeline: true, Concurrency: 4, Out: &out})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if summary.Added != 10 || strings.Count(out.String(), "Skipping ") != 10 {
+		t.Errorf("summary = %+v, output:\n%s", summary, out.String())
+	}
+}
+
+func TestRunSkipsArchivedRepositories(t *testing.T) {
+	tests := []struct {
+		name            string
+		includeArchived bool
+		added           int
+	}{
+		{"by default", false, 1},
+		{"includeArchived", true, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode([]Repository{{Name: "alpha"}, {Name: "beta", Archived: true}})
+			}))
+			defer github.Close()
+			sysdig := httptest.NewServer(&sysdigRecorder{})
+			defer sysdig.Close()
+
+			config := newTestConfig(github.URL, sysdig.URL)
+			config.Config.IncludeArchived = test.includeArchived
+			summary, err := run(config, Options{Yes: true, Out: ioutil.Discard})
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			// Filtered repositories are left out of the total
+			if summary.Added != test.added || summary.Total != test.added {
+				t.Errorf("summary = %+v", summary)
+			}
+		})
+	}
+}
+
+// finishedSink is an output sink that records whether it was finished, and
+// fails with err
+type finishedSink struct {
+	finished bool
+	err      error
+}
+
+func (s *finishedSink) RecordResult(Result) {}
+
+func (s *finishedSink) Finish(Summary) error {
+	s.finished = true
+	return s.err
+}
+
+func TestFinishSinksFinishesEverySink(t *testing.T) {
+	sinks := []*finishedSink{{err: errors.New("report failed")}, {}, {err: errors.New("webhook failed")}}
+	err := finishSinks([]OutputSink{sinks[0], sinks[1], sinks[2]}, Summary{})
+	if err == nil || err.Error() != "report failed; webhook failed" {
+		t.Errorf("finishSinks = %v", err)
+	}
+	for i, sink := range sinks {
+		if !sink.finished {
+			t.Errorf("sink %d was not finished", i)
+		}
+	}
+}
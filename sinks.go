@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutputSink receives the outcome of a run: every result as it happens, then
+// the summary. Several sinks can be enabled together.
+type OutputSink interface {
+	RecordResult(Result)
+	Finish(Summary) error
+}
+
+// consoleSink prints a line per repository and the summary to opts.Out
+type consoleSink struct {
+	messages *messageTemplates
+	opts     Options
+}
+
+func (s *consoleSink) RecordResult(result Result) {
+	printResult(s.messages, result, s.opts)
+}
+
+func (s *consoleSink) Finish(summary Summary) error {
+	fmt.Fprintln(s.opts.Out, summary)
+	if len(summary.Orgs) > 1 {
+		for _, status := range summary.Orgs {
+			if status.Error != "" {
+				fmt.Fprintf(s.opts.Out, "  %s: not listed\n", status.Org)
+			} else {
+				fmt.Fprintf(s.opts.Out, "  %s: %d added, %d updated, %d skipped, %d failed\n", status.Org, status.Added, status.Updated, status.Skipped, status.Failed)
+			}
+		}
+	}
+	return nil
+}
+
+// summarySink prints the totals of a run as a single JSON object, for
+// dashboards that don't need the per-repository results
+type summarySink struct {
+	out      io.Writer
+	start    time.Time
+	finished bool
+}
+
+func (s *summarySink) RecordResult(Result) {}
+
+func (s *summarySink) Finish(summary Summary) error {
+	return s.write(summary, "")
+}
+
+// fail prints the totals of a run that ended with an error, unless Finish
+// already printed them
+func (s *summarySink) fail(summary Summary, message string) {
+	if !s.finished {
+		s.write(summary, message)
+	}
+}
+
+func (s *summarySink) write(summary Summary, message string) error {
+	s.finished = true
+	if summary.FailedRepos == nil {
+		summary.FailedRepos = []string{}
+	}
+	return json.NewEncoder(s.out).Encode(struct {
+		Total             int            `json:"total"`
+		Added             int            `json:"added"`
+		Updated           int            `json:"updated"`
+		Removed           int            `json:"removed"`
+		Skipped           int            `json:"skipped"`
+		Failed            int            `json:"failed"`
+		FailedRepos       []string       `json:"failedRepos"`
+		FailureCategories map[string]int `json:"failureCategories,omitempty"`
+		Orgs              []OrgStatus    `json:"orgs,omitempty"`
+		DurationSeconds   float64        `json:"durationSeconds"`
+		Error             string         `json:"error,omitempty"`
+	}{summary.Total, summary.Added, summary.Updated, summary.Removed, summary.Skipped, summary.Failed,
+		summary.FailedRepos, summary.FailureCategories, summary.Orgs, time.Since(s.start).Seconds(), message})
+}
+
+// annotationSink prints GitHub Actions workflow commands for failed and
+// skipped repositories, so they show up as annotations of the run. Besides
+// the results, it gets the repositories the filters leave out through skip.
+type annotationSink struct {
+	out io.Writer
+
+	mu sync.Mutex
+	// skipped holds the owner/name of the repositories already annotated as
+	// skipped, since a skipped result is reported to skip first
+	skipped map[string]bool
+}
+
+func (s *annotationSink) RecordResult(result Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if result.Action == "failed" && result.removal {
+		fmt.Fprintf(s.out, "::error::%s\n", escapeAnnotation("Failed to remove "+result.Repo+": "+result.Error))
+	} else if result.Action == "failed" {
+		fmt.Fprintf(s.out, "::error::%s\n", escapeAnnotation("Failed to add "+result.Repo+": "+result.Error))
+	} else if result.Action == "skipped" && !s.skipped[result.Owner+"/"+result.Repo] {
+		fmt.Fprintf(s.out, "::warning::%s\n", escapeAnnotation("Skipped "+result.Repo+": "+result.Reason))
+	}
+}
+
+// skip annotates a repository left out by a skipReporter, see its notify.
+// Repositories merely not pushed since the last run aren't worth a warning.
+func (s *annotationSink) skip(entry skipEntry) {
+	if entry.Reason == "not-pushed" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.skipped == nil {
+		s.skipped = make(map[string]bool)
+	}
+	s.skipped[entry.Owner+"/"+entry.Repo] = true
+	fmt.Fprintf(s.out, "::warning::%s\n", escapeAnnotation("Skipped "+entry.Repo+": "+entry.Detail))
+}
+
+func (s *annotationSink) Finish(Summary) error {
+	return nil
+}
+
+// escapeAnnotation keeps a message on one workflow command line
+func escapeAnnotation(message string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(message)
+}
+
+// jsonFileSink writes the summary of a run as a JSON report
+type jsonFileSink struct {
+	filename string
+}
+
+func (s *jsonFileSink) RecordResult(Result) {}
+
+func (s *jsonFileSink) Finish(summary Summary) error {
+	err := writeReport(s.filename, summary)
+	if err != nil {
+		return fmt.Errorf("writing report: %v", err)
+	}
+	return nil
+}
+
+// ndjsonSink streams each result as a line of JSON as soon as it is known,
+// so a long run can be followed with tail -f
+type ndjsonSink struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newNDJSONSink(filename string) (*ndjsonSink, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonSink{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (s *ndjsonSink) RecordResult(result Result) {
+	s.encoder.Encode(result)
+}
+
+func (s *ndjsonSink) Finish(Summary) error {
+	return s.file.Close()
+}
+
+// webhookSink posts the summary as JSON to a URL. Like the summary email it
+// is best effort: a failure is a warning, not a failed run.
+type webhookSink struct {
+	url string
+	out io.Writer
+}
+
+func (s *webhookSink) RecordResult(Result) {}
+
+func (s *webhookSink) Finish(summary Summary) error {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("webhook answered %s", resp.Status)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(s.out, "Warning: could not post summary to webhook:", err)
+	}
+	return nil
+}
+
+// emailSink mails the summary through the configured SMTP relay, best effort
+type emailSink struct {
+	config *Config
+	out    io.Writer
+}
+
+func (s *emailSink) RecordResult(Result) {}
+
+func (s *emailSink) Finish(summary Summary) error {
+	err := sendSummaryEmail(s.config, summary)
+	if err != nil {
+		fmt.Fprintln(s.out, "Warning: could not send summary email:", err)
+	}
+	return nil
+}
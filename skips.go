@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// skipReporter announces the repositories a run leaves out and, with
+// -skip-audit, appends one JSON object per skipped repository to a file
+type skipReporter struct {
+	quiet bool
+	out   io.Writer
+	// notify, when set, is called with every skipped repository
+	notify func(skipEntry)
+
+	mu    sync.Mutex
+	file  *os.File
+	audit *json.Encoder
+}
+
+// skipEntry is a line of the skip audit. Reason is a stable code such as
+// "fork-of" or "min-stars"; Detail is the human readable explanation.
+type skipEntry struct {
+	Repo   string `json:"repo"`
+	Owner  string `json:"owner"`
+	Reason string `json:"reason"`
+	Detail string `json:"detail"`
+}
+
+// newSkipReporter returns a reporter writing its audit to filename, if set
+func newSkipReporter(filename string, quiet bool) (*skipReporter, error) {
+	skips := &skipReporter{quiet: quiet, out: os.Stdout}
+	if filename != "" {
+		file, err := os.Create(filename)
+		if err != nil {
+			return nil, fmt.Errorf("creating skip audit: %v", err)
+		}
+		skips.file = file
+		skips.audit = json.NewEncoder(file)
+	}
+	return skips, nil
+}
+
+// skip prints why a repository is skipped and records it in the audit
+func (s *skipReporter) skip(repo Repository, reason, detail string) {
+	if !s.quiet {
+		fmt.Fprintf(s.out, "Skipping %s: %s\n", repo.Name, detail)
+	}
+	s.record(repo, reason, detail)
+}
+
+// record only adds a skipped repository to the audit, for skips that are
+// reported elsewhere or not worth a line of output
+func (s *skipReporter) record(repo Repository, reason, detail string) {
+	if s.notify != nil {
+		s.notify(skipEntry{Repo: repo.Name, Owner: repo.Owner.Login, Reason: reason, Detail: detail})
+	}
+	if s.audit == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit.Encode(skipEntry{Repo: repo.Name, Owner: repo.Owner.Login, Reason: reason, Detail: detail})
+}
+
+// close closes the audit file
+func (s *skipReporter) close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// State is what a run remembers for the next one, kept in the stateFile
+type State struct {
+	LastRun time.Time `json:"lastRun"`
+	// Sources are the sources registered so far, by source name
+	Sources map[string]StateSource `json:"sources,omitempty"`
+	// GitHubCache holds the GitHub responses of the last run by URL, so
+	// unchanged listings can be answered with 304 Not Modified
+	GitHubCache map[string]CachedResponse `json:"githubCache,omitempty"`
+}
+
+// StateSource is a registered source and the configuration it was sent with.
+// ID is empty for sources that already existed when they were recorded.
+// Hash is that of the payload last sent, with the folder globs expanded.
+// RepoID is the GitHub ID of the repository, used to detect renames.
+type StateSource struct {
+	ID     string     `json:"id,omitempty"`
+	RepoID int64      `json:"repoId,omitempty"`
+	Source SourceSpec `json:"source"`
+	Hash   string     `json:"hash,omitempty"`
+}
+
+// loadState reads the state file. A missing file is a first run and yields an
+// empty state.
+func loadState(filename string) (*State, error) {
+	var state State
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// record remembers a source registered with the given configuration
+func (s *State) record(name, id string, repoID int64, source SourceSpec, hash string) {
+	if s.Sources == nil {
+		s.Sources = make(map[string]StateSource)
+	}
+	if id == "" {
+		id = s.Sources[name].ID
+	}
+	s.Sources[name] = StateSource{ID: id, RepoID: repoID, Source: source, Hash: hash}
+}
+
+// recorded returns a copy of the recorded sources of the given names, which
+// workers can read while others record their sources. A renamed repository
+// gets the source recorded under its old name.
+func (s *State) recorded(names map[string]bool, renames map[string]string) map[string]SourceSpec {
+	sources := make(map[string]SourceSpec)
+	for name := range names {
+		recorded := name
+		if old, renamed := renames[name]; renamed {
+			recorded = old
+		}
+		if source, found := s.Sources[recorded]; found {
+			sources[name] = source.Source
+		}
+	}
+	return sources
+}
+
+// renames returns the old source names of the repositories renamed since they
+// were recorded, by new source name. Repositories are matched by GitHub ID.
+func (s *State) renames(repositories []Repository, names []string) map[string]string {
+	current := make(map[string]bool)
+	for _, name := range names {
+		current[name] = true
+	}
+	byID := make(map[int64]string)
+	for name, source := range s.Sources {
+		if source.RepoID != 0 && !current[name] {
+			byID[source.RepoID] = name
+		}
+	}
+
+	renames := make(map[string]string)
+	for i, repo := range repositories {
+		if _, found := s.Sources[names[i]]; found || repo.ID == 0 {
+			continue
+		}
+		if old, found := byID[repo.ID]; found {
+			renames[names[i]] = old
+		}
+	}
+	return renames
+}
+
+// save writes the state file, replacing it atomically so an interrupted run
+// never leaves a truncated file behind
+func (s *State) save(filename string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,824 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Source struct for Sysdig git source API responses
+type Source struct {
+	ID                  string            `yaml:"id" json:"id"`
+	Name                string            `yaml:"name" json:"name"`
+	Repository          string            `yaml:"repository" json:"repository"`
+	Folders             []string          `yaml:"folders" json:"folders"`
+	PRScanBranchPattern string            `yaml:"prScanBranchPattern" json:"prScanBranchPattern"`
+	IntegrationID       string            `yaml:"integrationId" json:"integrationId"`
+	Status              string            `yaml:"status,omitempty" json:"status"`
+	Labels              map[string]string `yaml:"labels,omitempty" json:"labels"`
+	ScanSchedule        string            `yaml:"scanSchedule,omitempty" json:"scanSchedule"`
+	ScanTriggers        []string          `yaml:"scanTriggers,omitempty" json:"scanTriggers"`
+}
+
+// spec returns the configuration of an existing source
+func (s Source) spec() SourceSpec {
+	return SourceSpec{
+		Repository:          s.Repository,
+		Folders:             s.Folders,
+		PRScanBranchPattern: s.PRScanBranchPattern,
+		IntegrationID:       s.IntegrationID,
+		Name:                s.Name,
+		Labels:              s.Labels,
+		ScanSchedule:        s.ScanSchedule,
+		ScanTriggers:        s.ScanTriggers,
+	}
+}
+
+// SourcePayload is the body sent to create or update a git source
+type SourcePayload struct {
+	Source SourceSpec `json:"source"`
+}
+
+// SourceSpec is the desired configuration of a git source. Its fields are
+// marshaled in declaration order, so payloads are byte for byte stable.
+type SourceSpec struct {
+	Repository          string            `json:"repository"`
+	Folders             []string          `json:"folders"`
+	PRScanBranchPattern string            `json:"prScanBranchPattern"`
+	IntegrationID       string            `json:"integrationId"`
+	Name                string            `json:"name"`
+	Labels              map[string]string `json:"labels,omitempty"`
+	ScanSchedule        string            `json:"scanSchedule,omitempty"`
+	ScanTriggers        []string          `json:"scanTriggers,omitempty"`
+}
+
+// hash returns a digest of the configuration, equal for sources configured
+// alike. Marshaling is stable, see SourceSpec.
+func (s SourceSpec) hash() string {
+	data, _ := json.Marshal(s)
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// sysdigMaxRetries is how many times a rate limited or failing Sysdig request
+// is retried before giving up
+const sysdigMaxRetries = 3
+
+// sysdigErrorLength is how many characters of an error body are quoted
+const sysdigErrorLength = 200
+
+// SysdigError is returned when the Sysdig API answers with an error status.
+// Body is the whole response; the message only quotes its start on one line,
+// so the request IDs that follow it on a failure line stay in sight.
+type SysdigError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *SysdigError) Error() string {
+	body := []rune(strings.Join(strings.Fields(e.Body), " "))
+	if len(body) > sysdigErrorLength {
+		return fmt.Sprintf("Sysdig API request failed (%d): %s...", e.StatusCode, string(body[:sysdigErrorLength]))
+	}
+	return fmt.Sprintf("Sysdig API request failed (%d): %s", e.StatusCode, string(body))
+}
+
+// SysdigClient manages git sources through the Sysdig Secure git provider API
+type SysdigClient struct {
+	BaseURL string
+	Token   string
+	HTTP    *http.Client
+	// OAuth, when set, supplies the bearer tokens in place of Token
+	OAuth *oauthToken
+	// FieldMap renames the JSON keys of sent sources, see sourcePayload
+	FieldMap map[string]string
+	// Unwrapped sends the fields of sources at the top level of the body,
+	// without the source envelope
+	Unwrapped bool
+	// Cooldown, when set, pauses every request after a 429 without a
+	// usable Retry-After
+	Cooldown *cooldown
+	// Throttles counts the 429 responses of the client and its clones
+	Throttles *int64
+	// MaxResponseBytes bounds the responses read, see readBody
+	MaxResponseBytes int64
+
+	record func(Exchange)
+}
+
+// Exchange is a request sent to the Sysdig API and the response it got back
+type Exchange struct {
+	Method  string
+	URL     string
+	Header  http.Header
+	Payload []byte
+	Status  int
+	Body    []byte
+	Err     error
+	// RequestID is the X-Request-ID sent and SysdigRequestID the one
+	// Sysdig answered with, if any
+	RequestID       string
+	SysdigRequestID string
+}
+
+// NewSysdigClient returns a client for the Sysdig API described by the config
+func NewSysdigClient(config *Config) (*SysdigClient, error) {
+	client, err := newSysdigHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SysdigClient{
+		BaseURL:   config.sysdigAPIURL(),
+		Token:     config.Config.SecureAPIToken,
+		HTTP:      client,
+		OAuth:     newOAuthToken(client, config.Config.Auth, config.Config.MaxResponseBytes),
+		FieldMap:  config.Config.PayloadFieldMap,
+		Unwrapped: !config.wrapInSource(),
+		Cooldown:  newCooldown(time.Duration(config.Config.SysdigRateLimitCooldown) * time.Second),
+		Throttles: new(int64),
+
+		MaxResponseBytes: config.Config.MaxResponseBytes,
+	}, nil
+}
+
+// newSysdigHTTPClient returns the HTTP client used for the Sysdig API, set up
+// with the configured CA and client certificate for mutual TLS
+func newSysdigHTTPClient(config *Config) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if config.Config.CACertFile != "" {
+		pem, err := ioutil.ReadFile(config.Config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("caCertFile: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("caCertFile: no certificates found in %s", config.Config.CACertFile)
+		}
+	}
+
+	if config.Config.ClientCertFile != "" || config.Config.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.Config.ClientCertFile, config.Config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.Config.InsecureSkipVerify {
+		fmt.Fprintln(os.Stderr, "WARNING: TLS certificate verification is disabled for the Sysdig API. This is only meant for testing against mocks and must never be used in production.")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if config.Config.NoTLSSessionCache {
+		withoutConnectionReuse(transport)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// withoutConnectionReuse makes a transport open a new connection, with a full
+// TLS handshake, for every request. It is only meant to diagnose flaky TLS
+// through proxies.
+func withoutConnectionReuse(transport *http.Transport) *http.Transport {
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.ClientSessionCache = nil
+	transport.DisableKeepAlives = true
+	return transport
+}
+
+// recording returns a copy of the client that passes every exchange to record
+func (c *SysdigClient) recording(record func(Exchange)) *SysdigClient {
+	clone := *c
+	clone.record = record
+	return &clone
+}
+
+// CreateSource creates a git source and returns it as Sysdig reported it
+func (c *SysdigClient) CreateSource(ctx context.Context, source SourceSpec) (*Source, error) {
+	payload, err := sourcePayload(c.FieldMap, !c.Unwrapped, source)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.do(ctx, "POST", c.BaseURL+"/gitSources", payload)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSource(c.FieldMap, body), nil
+}
+
+// sourcePayload returns the body sent for a source, with its keys renamed by
+// fieldMap, such as integrationId to integration_id, and under a source key
+// when wrap is set. Renamed payloads are marshaled with their keys sorted,
+// which is stable too.
+func sourcePayload(fieldMap map[string]string, wrap bool, source SourceSpec) (interface{}, error) {
+	if len(fieldMap) == 0 && wrap {
+		return SourcePayload{Source: source}, nil
+	} else if len(fieldMap) == 0 {
+		return source, nil
+	}
+
+	data, err := json.Marshal(source)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	renamed := make(map[string]json.RawMessage)
+	for key, value := range fields {
+		if mapped := fieldMap[key]; mapped != "" {
+			key = mapped
+		}
+		renamed[key] = value
+	}
+	if !wrap {
+		return renamed, nil
+	}
+	return map[string]interface{}{"source": renamed}, nil
+}
+
+// unmapSource decodes a source whose keys fieldMap renames, the reverse of
+// sourcePayload. A key of a renamed field is not the field's, so it is
+// ignored: with name renamed to title, name is not read as the name.
+func unmapSource(fieldMap map[string]string, data []byte, source *Source) error {
+	if len(fieldMap) == 0 {
+		return json.Unmarshal(data, source)
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	fieldOf := make(map[string]string)
+	for field, key := range fieldMap {
+		fieldOf[key] = field
+	}
+	renamed := make(map[string]json.RawMessage)
+	for key, value := range fields {
+		if field, found := fieldOf[key]; found {
+			renamed[field] = value
+		} else if fieldMap[key] == "" {
+			renamed[key] = value
+		}
+	}
+
+	data, err = json.Marshal(renamed)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, source)
+}
+
+// ListSources fetches every git source registered in Sysdig, following the
+// page cursors of paginated responses
+func (c *SysdigClient) ListSources(ctx context.Context) ([]Source, error) {
+	var sources []Source
+	url := c.BaseURL + "/gitSources"
+	for url != "" {
+		body, header, err := c.send(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var list struct {
+			Sources []json.RawMessage `json:"sources"`
+			Page    struct {
+				Next string `json:"next"`
+			} `json:"page"`
+		}
+		err = decodeJSON(body, header.Get("Content-Type"), &list)
+		if err != nil {
+			return nil, fmt.Errorf("Sysdig API %v", err)
+		}
+		for _, data := range list.Sources {
+			var source Source
+			err = unmapSource(c.FieldMap, data, &source)
+			if err != nil {
+				return nil, fmt.Errorf("Sysdig API returned an unexpected source: %v", err)
+			}
+			sources = append(sources, source)
+		}
+
+		url = ""
+		if list.Page.Next != "" {
+			url = c.BaseURL + "/gitSources?cursor=" + neturl.QueryEscape(list.Page.Next)
+		}
+	}
+
+	return sources, nil
+}
+
+// GetSource fetches a git source by ID
+func (c *SysdigClient) GetSource(ctx context.Context, id string) (*Source, error) {
+	body, err := c.do(ctx, "GET", c.BaseURL+"/gitSources/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSource(c.FieldMap, body), nil
+}
+
+// UpdateSource replaces the configuration of an existing git source
+func (c *SysdigClient) UpdateSource(ctx context.Context, id string, source SourceSpec) (*Source, error) {
+	payload, err := sourcePayload(c.FieldMap, !c.Unwrapped, source)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.do(ctx, "PUT", c.BaseURL+"/gitSources/"+id, payload)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSource(c.FieldMap, body), nil
+}
+
+// DeleteSource removes a git source
+func (c *SysdigClient) DeleteSource(ctx context.Context, id string) error {
+	_, err := c.do(ctx, "DELETE", c.BaseURL+"/gitSources/"+id, nil)
+	return err
+}
+
+// do sends a request with an optional JSON payload and returns the response
+// body. Rate limited (429) requests are retried with backoff, as are server
+// errors unless the request is a POST, and error statuses are returned as a
+// *SysdigError.
+func (c *SysdigClient) do(ctx context.Context, method, url string, payload interface{}) ([]byte, error) {
+	body, _, err := c.send(ctx, method, url, payload)
+	return body, err
+}
+
+// send is do, also returning the response headers
+func (c *SysdigClient) send(ctx context.Context, method, url string, payload interface{}) ([]byte, http.Header, error) {
+	var data []byte
+	if payload != nil {
+		var err error
+		data, err = json.Marshal(payload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal JSON: %v", err)
+		}
+	}
+
+	// Retries keep the ID, so Sysdig can tie them together
+	requestID := newRequestID()
+
+	for attempt := 0; ; attempt++ {
+		if err := c.Cooldown.wait(ctx); err != nil {
+			return nil, nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		token := c.Token
+		if c.OAuth != nil {
+			token, err = c.OAuth.accessToken(ctx)
+			if err != nil {
+				return nil, nil, fmt.Errorf("fetching Sysdig access token: %v", err)
+			}
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Request-ID", requestID)
+		req.Header.Set("Accept", "application/json")
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.HTTP.Do(req)
+		if err != nil {
+			if c.record != nil {
+				c.record(Exchange{Method: method, URL: url, Header: req.Header, Payload: data, Err: err, RequestID: requestID})
+			}
+			return nil, nil, err
+		}
+		body, err := readBody(resp.Body, c.MaxResponseBytes)
+		resp.Body.Close()
+		if c.record != nil {
+			c.record(Exchange{Method: method, URL: url, Header: req.Header, Payload: data, Status: resp.StatusCode, Body: body, Err: err,
+				RequestID: requestID, SysdigRequestID: resp.Header.Get("X-Request-ID")})
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return body, resp.Header, nil
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && c.Throttles != nil {
+			atomic.AddInt64(c.Throttles, 1)
+		}
+		// Sysdig may have created a source before failing, and a second
+		// POST would create it again, so creates are only retried when
+		// rejected by the rate limit
+		retryable := resp.StatusCode == http.StatusTooManyRequests || (resp.StatusCode >= 500 && method != "POST")
+		if !retryable || attempt >= sysdigMaxRetries {
+			return nil, nil, &SysdigError{StatusCode: resp.StatusCode, Body: string(body)}
+		}
+
+		delay := time.Second << attempt
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			delay = time.Duration(seconds) * time.Second
+		} else if resp.StatusCode == http.StatusTooManyRequests && c.Cooldown != nil {
+			// The cooldown holds this request along with the others
+			c.Cooldown.start()
+			delay = 0
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// defaultMaxResponseBytes bounds the responses read when maxResponseBytes is
+// not set
+const defaultMaxResponseBytes = 10 << 20
+
+// readBody reads a response body of at most max bytes, or
+// defaultMaxResponseBytes when max is zero, so a pathological response can't
+// exhaust memory. A larger body is an error.
+func readBody(body io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		max = defaultMaxResponseBytes
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, max+1))
+	if err != nil {
+		return data, err
+	} else if int64(len(data)) > max {
+		return data[:max], fmt.Errorf("response larger than maxResponseBytes (%d bytes), raise it if such responses are expected", max)
+	}
+	return data, nil
+}
+
+// cooldown pauses the requests of every worker for a while once the
+// tenant's rate limit was hit, since they all share it
+type cooldown struct {
+	period time.Duration
+
+	mu    sync.Mutex
+	until time.Time
+}
+
+// newCooldown returns nil, which never pauses, for a zero period
+func newCooldown(period time.Duration) *cooldown {
+	if period <= 0 {
+		return nil
+	}
+	return &cooldown{period: period}
+}
+
+// start pauses requests for the cooldown period from now
+func (c *cooldown) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if until := time.Now().Add(c.period); until.After(c.until) {
+		c.until = until
+	}
+}
+
+// wait blocks until the cooldown, if any, is over
+func (c *cooldown) wait(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	delay := time.Until(c.until)
+	c.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// newRequestID returns a random (version 4) UUID to trace a request by
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// decodeSource reads the source returned by a create, get or update, with its
+// keys renamed by fieldMap like the request. Sysdig may or may not wrap it in
+// a "source" envelope; a body that isn't a source at all yields an empty one.
+func decodeSource(fieldMap map[string]string, body []byte) *Source {
+	var envelope struct {
+		Wrapped json.RawMessage `json:"source"`
+	}
+	if json.Unmarshal(body, &envelope) != nil {
+		return &Source{}
+	} else if len(envelope.Wrapped) > 0 && string(envelope.Wrapped) != "null" {
+		body = envelope.Wrapped
+	}
+
+	var source Source
+	if unmapSource(fieldMap, body, &source) != nil {
+		return &Source{}
+	}
+	return &source
+}
+
+// Fetch the git sources already registered in Sysdig, by name
+func getExistingSources(ctx context.Context, sysdig *SysdigClient) (map[string]Source, error) {
+	sources, err := sysdig.ListSources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]Source)
+	for _, source := range sources {
+		existing[source.Name] = source
+	}
+
+	return existing, nil
+}
+
+// sourceInError reports whether Sysdig lists a source as broken, such as
+// one left half created by an earlier failed run
+func sourceInError(source Source) bool {
+	status := strings.ToLower(source.Status)
+	return strings.Contains(status, "error") || strings.Contains(status, "fail")
+}
+
+// RegisterSource creates a Sysdig git source and returns the outcome: added,
+// with the source ID and status Sysdig reported, skipped when the source
+// already exists, or failed with the error. StatusCode is that of Sysdig's
+// last response.
+func RegisterSource(ctx context.Context, sysdig *SysdigClient, config *Config, source SourceSpec) Result {
+	start := time.Now()
+	result := Result{Repo: source.Repository}
+	record := sysdig.record
+	client := sysdig.recording(func(ex Exchange) {
+		result.StatusCode = ex.Status
+		if record != nil {
+			record(ex)
+		}
+	})
+
+	created, err := client.CreateSource(ctx, source)
+	if apiErr, ok := err.(*SysdigError); ok && apiErr.StatusCode == http.StatusConflict && config.Config.Idempotent {
+		result.Action, result.Reason = "skipped", "source already exists"
+	} else if err != nil {
+		result.Action, result.Err = "failed", err
+	} else {
+		result.Action, result.SourceID, result.Status = "added", created.ID, created.Status
+	}
+	result.Duration = time.Since(start)
+	return result
+}
+
+// buildSource returns the desired source for a repository, applying the
+// global configuration and the repository's overrides
+func buildSource(config *Config, repo Repository, name string) SourceSpec {
+	source := SourceSpec{
+		Repository:          repo.Name,
+		Folders:             sourceFolders(config, repo),
+		PRScanBranchPattern: branchPattern(config, repo),
+		IntegrationID:       integrationID(config, repo),
+		Name:                name,
+	}
+	if labels := sourceLabels(config, repo); len(labels) > 0 {
+		source.Labels = labels
+	}
+	source.ScanSchedule = scanSchedule(config, repo)
+	source.ScanTriggers = scanTriggers(config, repo)
+	return source
+}
+
+// verifySource checks that a newly created or updated source can be read
+// back from Sysdig with the configuration that was sent. It is fetched by ID,
+// or found by name in the listing when Sysdig returned no ID.
+func verifySource(ctx context.Context, sysdig *SysdigClient, id string, want SourceSpec) error {
+	var source *Source
+	if id != "" {
+		var err error
+		source, err = sysdig.GetSource(ctx, id)
+		if err != nil {
+			return fmt.Errorf("verification failed: %v", err)
+		}
+	} else {
+		sources, err := sysdig.ListSources(ctx)
+		if err != nil {
+			return fmt.Errorf("verification failed: %v", err)
+		}
+		for i := range sources {
+			if sources[i].Name == want.Name {
+				source = &sources[i]
+				break
+			}
+		}
+		if source == nil {
+			return fmt.Errorf("verification failed: source %s not found", want.Name)
+		}
+	}
+
+	var mismatches []string
+	if source.Repository != want.Repository {
+		mismatches = append(mismatches, fmt.Sprintf("repository is %q", source.Repository))
+	}
+	if source.IntegrationID != want.IntegrationID {
+		mismatches = append(mismatches, fmt.Sprintf("integrationId is %q", source.IntegrationID))
+	}
+	if source.PRScanBranchPattern != want.PRScanBranchPattern {
+		mismatches = append(mismatches, fmt.Sprintf("prScanBranchPattern is %q", source.PRScanBranchPattern))
+	}
+	if strings.Join(source.Folders, ",") != strings.Join(want.Folders, ",") {
+		mismatches = append(mismatches, fmt.Sprintf("folders are %v", source.Folders))
+	}
+	if (len(source.Labels) > 0 || len(want.Labels) > 0) && !reflect.DeepEqual(source.Labels, want.Labels) {
+		mismatches = append(mismatches, fmt.Sprintf("labels are %v", source.Labels))
+	}
+	if source.ScanSchedule != want.ScanSchedule {
+		mismatches = append(mismatches, fmt.Sprintf("scanSchedule is %q", source.ScanSchedule))
+	}
+	if strings.Join(source.ScanTriggers, ",") != strings.Join(want.ScanTriggers, ",") {
+		mismatches = append(mismatches, fmt.Sprintf("scanTriggers are %v", source.ScanTriggers))
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("verification failed: %s", strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// rollbackSource deletes a just-created source that failed verification and
+// returns the verification error, noting whether the source was removed
+func rollbackSource(ctx context.Context, sysdig *SysdigClient, id string, verifyErr error) error {
+	if id == "" {
+		return fmt.Errorf("%v, not rolled back: Sysdig returned no source id", verifyErr)
+	}
+	err := sysdig.DeleteSource(ctx, id)
+	if err != nil {
+		return fmt.Errorf("%v, rollback of source %s failed: %v", verifyErr, id, err)
+	}
+	return fmt.Errorf("%v, source %s rolled back", verifyErr, id)
+}
+
+// branchPattern returns the PR scan branch pattern of a repository. An empty
+// prScanBranchPattern falls back to the repository's default branch unless
+// branchPatternFallback is "literal".
+func branchPattern(config *Config, repo Repository) string {
+	pattern := config.Config.PRScanBranchPattern
+	for _, override := range config.repoConfigs(repo.Name) {
+		if override.PRScanBranchPattern != "" {
+			pattern = override.PRScanBranchPattern
+		}
+	}
+	if pattern == "" && config.Config.BranchPatternFallback != "literal" {
+		pattern = repo.DefaultBranch
+	}
+	return pattern
+}
+
+// sourceFolders returns the folders scanned in a repository. A repoConfig
+// list replaces the global one.
+func sourceFolders(config *Config, repo Repository) []string {
+	folders := config.Config.Folders
+	for _, override := range config.repoConfigs(repo.Name) {
+		if override.Folders != nil {
+			folders = override.Folders
+		}
+	}
+	return folders
+}
+
+// integrationID returns the integration a repository's source belongs to
+func integrationID(config *Config, repo Repository) string {
+	id := config.Config.IntegrationID
+	for _, override := range config.repoConfigs(repo.Name) {
+		if override.IntegrationID != "" {
+			id = override.IntegrationID
+		}
+	}
+	return id
+}
+
+// sourceLabels returns the labels of a repository's source: the global labels
+// overridden by the matching repoConfig entries, with placeholders expanded
+func sourceLabels(config *Config, repo Repository) map[string]string {
+	labels := make(map[string]string)
+	for key, value := range config.Config.Labels {
+		labels[key] = value
+	}
+	for _, override := range config.repoConfigs(repo.Name) {
+		for key, value := range override.Labels {
+			labels[key] = value
+		}
+	}
+
+	for key, value := range labels {
+		labels[key] = expandPlaceholders(value, repo)
+	}
+	return labels
+}
+
+// ciLabels returns the labels stamped on the sources a run creates, to trace
+// them back to it: for each ciLabels entry, the value of the first of its
+// environment variables that is set, such as GITHUB_SHA or CI_COMMIT_SHA
+func ciLabels(config *Config) map[string]string {
+	labels := make(map[string]string)
+	for label, names := range config.Config.CILabels {
+		for _, name := range names {
+			if value := os.Getenv(name); value != "" {
+				labels[label] = value
+				break
+			}
+		}
+	}
+	return labels
+}
+
+// unstamped returns the source without the labels named by ciLabels, so a
+// listed source that was stamped compares equal to its configuration
+func unstamped(config *Config, source SourceSpec) SourceSpec {
+	labels := make(map[string]string)
+	for key, value := range source.Labels {
+		if len(config.Config.CILabels[key]) == 0 {
+			labels[key] = value
+		}
+	}
+	if len(labels) == len(source.Labels) {
+		return source
+	} else if len(labels) == 0 {
+		labels = nil
+	}
+	source.Labels = labels
+	return source
+}
+
+// withLabels returns the source with the extra labels added. Its own labels
+// win, and its map is left untouched.
+func withLabels(source SourceSpec, extra map[string]string) SourceSpec {
+	if len(extra) == 0 {
+		return source
+	}
+	labels := make(map[string]string)
+	for key, value := range extra {
+		labels[key] = value
+	}
+	for key, value := range source.Labels {
+		labels[key] = value
+	}
+	source.Labels = labels
+	return source
+}
+
+// scanSchedule returns the scan schedule of a repository's source, the most
+// specific repoConfig schedule winning over the global one
+func scanSchedule(config *Config, repo Repository) string {
+	schedule := config.Config.ScanSchedule
+	for _, override := range config.repoConfigs(repo.Name) {
+		if override.ScanSchedule != "" {
+			schedule = override.ScanSchedule
+		}
+	}
+	return schedule
+}
+
+// scanTriggers returns the scan triggers of a repository's source. A
+// repoConfig list replaces the global one rather than adding to it.
+func scanTriggers(config *Config, repo Repository) []string {
+	triggers := config.Config.ScanTriggers
+	for _, override := range config.repoConfigs(repo.Name) {
+		if override.ScanTriggers != nil {
+			triggers = override.ScanTriggers
+		}
+	}
+	return triggers
+}
+
+// sourceName returns the name of the Sysdig source for a repository
+func sourceName(repo string) string {
+	return fmt.Sprintf("%s_source", repo)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+func TestSourcePayloadGolden(t *testing.T) {
+	config := newTestConfig("", "")
+	config.Config.Labels = map[string]string{"team": "platform", "owner": "${owner}", "env": "prod"}
+
+	var repo Repository
+	repo.Name = "alpha"
+	repo.Owner.Login = "acme"
+
+	got, err := json.Marshal(SourcePayload{Source: buildSource(config, repo, sourceName(repo.Name))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := "testdata/source_payload.golden"
+	if *update {
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("payload changed, run go test -update if intended\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSourcePayloadUnwrapped(t *testing.T) {
+	source := SourceSpec{Name: "alpha_source", Repository: "alpha", IntegrationID: "integration-1"}
+	for _, fieldMap := range []map[string]string{nil, {"integrationId": "integration_id"}} {
+		payload, err := sourcePayload(fieldMap, false, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var fields map[string]interface{}
+		json.Unmarshal(data, &fields)
+		if fields["source"] != nil || fields["name"] != "alpha_source" {
+			t.Errorf("payload with fieldMap %v = %s, want the fields at the top level", fieldMap, data)
+		}
+	}
+}
+
+func TestOAuthTokenRefresh(t *testing.T) {
+	for _, test := range []struct {
+		expiresIn int
+		fetches   int
+	}{
+		{3600, 1},
+		{1, 2}, // within the expiry margin, so expired right away
+	} {
+		fetches := 0
+		tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_id") != "id" || r.Form.Get("client_secret") != "secret" {
+				t.Errorf("token request form = %v", r.Form)
+			}
+			fetches++
+			fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": %d}`, fetches, test.expiresIn)
+		}))
+		var bearers []string
+		sysdig := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bearers = append(bearers, r.Header.Get("Authorization"))
+			w.Write([]byte(`{"sources": []}`))
+		}))
+
+		config := newTestConfig("", sysdig.URL)
+		config.Config.SecureAPIToken = ""
+		config.Config.Auth = SysdigAuth{ClientID: "id", ClientSecret: "secret", TokenURL: tokens.URL}
+		if err := config.Validate(); err != nil {
+			t.Fatalf("Validate: %v", err)
+		}
+		client, err := NewSysdigClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := client.ListSources(context.Background()); err != nil {
+				t.Fatalf("ListSources: %v", err)
+			}
+		}
+		tokens.Close()
+		sysdig.Close()
+
+		if fetches != test.fetches {
+			t.Errorf("expires_in %d: %d tokens fetched, want %d", test.expiresIn, fetches, test.fetches)
+		}
+		if want := fmt.Sprintf("Bearer token-%d", test.fetches); bearers[1] != want {
+			t.Errorf("expires_in %d: second request sent %q, want %q", test.expiresIn, bearers[1], want)
+		}
+	}
+}
+
+func TestRegisterSourceResult(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		idempotent bool
+		action     string
+		sourceID   string
+		failed     bool
+	}{
+		{"created", http.StatusCreated, `{"id": "s1", "status": "ok"}`, false, "added", "s1", false},
+		{"conflict, idempotent", http.StatusConflict, `already exists`, true, "skipped", "", false},
+		{"conflict", http.StatusConflict, `already exists`, false, "failed", "", true},
+		{"rejected", http.StatusBadRequest, `bad folders`, false, "failed", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sysdig := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer sysdig.Close()
+			config := newTestConfig("", sysdig.URL)
+			config.Config.Idempotent = test.idempotent
+			client, err := NewSysdigClient(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := RegisterSource(context.Background(), client, config, SourceSpec{Name: "alpha_source", Repository: "alpha"})
+			if result.Repo != "alpha" || result.Action != test.action || result.SourceID != test.sourceID || result.StatusCode != test.status {
+				t.Errorf("result = %+v", result)
+			}
+			if (result.Err != nil) != test.failed {
+				t.Errorf("Err = %v", result.Err)
+			}
+			if result.Duration <= 0 {
+				t.Errorf("Duration = %v", result.Duration)
+			}
+		})
+	}
+}
+
+func TestReadBodyLimit(t *testing.T) {
+	data, err := readBody(strings.NewReader("0123456789"), 10)
+	if err != nil || string(data) != "0123456789" {
+		t.Fatalf("body at the limit: %q, %v", data, err)
+	}
+	_, err = readBody(strings.NewReader("0123456789a"), 10)
+	if err == nil || !strings.Contains(err.Error(), "maxResponseBytes") {
+		t.Fatalf("body over the limit: %v", err)
+	}
+}
+
+func TestVerifySource(t *testing.T) {
+	want := SourceSpec{Name: "alpha_source", Repository: "alpha", Folders: []string{"/"}, Labels: map[string]string{"team": "platform"}, ScanSchedule: "daily"}
+	stored := Source{ID: "s1", Name: "alpha_source", Repository: "alpha", Folders: []string{"/"}, Labels: map[string]string{"team": "platform"}, ScanSchedule: "daily"}
+	relabeled := stored
+	relabeled.Labels = nil
+	tests := []struct {
+		name   string
+		id     string
+		stored Source
+		path   string
+		failed string
+	}{
+		{"by id", "s1", stored, "/gitSources/s1", ""},
+		{"by name", "", stored, "/gitSources", ""},
+		{"labels differ", "s1", relabeled, "/gitSources/s1", "labels are map[]"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sysdig := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "GET" || r.URL.Path != "/api/cspm/v1/gitProvider"+test.path {
+					t.Errorf("unexpected Sysdig request: %s %s", r.Method, r.URL.Path)
+				} else if test.id == "" {
+					json.NewEncoder(w).Encode(map[string]interface{}{"sources": []Source{test.stored}})
+				} else {
+					json.NewEncoder(w).Encode(test.stored)
+				}
+			}))
+			defer sysdig.Close()
+			client, err := NewSysdigClient(newTestConfig("", sysdig.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = verifySource(context.Background(), client, test.id, want)
+			if test.failed == "" && err != nil {
+				t.Errorf("verifySource: %v", err)
+			} else if test.failed != "" && (err == nil || !strings.Contains(err.Error(), test.failed)) {
+				t.Errorf("verifySource error = %v, want %s", err, test.failed)
+			}
+		})
+	}
+}
+
+func TestSysdigErrorStaysOnOneLine(t *testing.T) {
+	err := &SysdigError{StatusCode: 500, Body: "<html>\n  <body>\n" + strings.Repeat("stack frame\n", 500) + "</html>\n"}
+	msg := err.Error()
+	if strings.Contains(msg, "\n") || len(msg) > 250 || !strings.HasPrefix(msg, "Sysdig API request failed (500): <html> <body> stack frame") {
+		t.Errorf("Error() = %q", msg)
+	}
+}
+
+func TestMappedSourcesRoundTrip(t *testing.T) {
+	// Sysdig answers with the keys it was sent, where repository takes the
+	// key name of the source name
+	var stored map[string]interface{}
+	sysdig := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST":
+			var payload map[string]map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&payload)
+			stored = payload["source"]
+			stored["id"] = "s1"
+			json.NewEncoder(w).Encode(stored)
+		case r.URL.Path == "/api/cspm/v1/gitProvider/gitSources":
+			json.NewEncoder(w).Encode(map[string]interface{}{"sources": []interface{}{stored}})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"source": stored})
+		}
+	}))
+	defer sysdig.Close()
+	config := newTestConfig("", sysdig.URL)
+	config.Config.PayloadFieldMap = map[string]string{"name": "source_name", "repository": "name", "integrationId": "integration_id"}
+	client, err := NewSysdigClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := buildSource(config, Repository{Name: "alpha"}, sourceName("alpha"))
+	created, err := client.CreateSource(context.Background(), want)
+	if err != nil {
+		t.Fatalf("CreateSource: %v", err)
+	}
+	if created.ID != "s1" || created.Name != want.Name || created.Repository != want.Repository || created.IntegrationID != want.IntegrationID {
+		t.Errorf("created = %+v", created)
+	}
+	sources, err := client.ListSources(context.Background())
+	if err != nil {
+		t.Fatalf("ListSources: %v", err)
+	}
+	if len(sources) != 1 || !reflect.DeepEqual(sources[0].spec(), want) {
+		t.Errorf("listed = %+v, want %+v", sources, want)
+	}
+	for _, id := range []string{"s1", ""} {
+		if err := verifySource(context.Background(), client, id, want); err != nil {
+			t.Errorf("verifySource(%q): %v", id, err)
+		}
+	}
+}
+
+func TestSysdigRetriesCreatesOnlyWhenRateLimited(t *testing.T) {
+	tests := []struct {
+		method   string
+		status   int
+		attempts int
+	}{
+		{"POST", http.StatusTooManyRequests, 2},
+		{"POST", http.StatusInternalServerError, 1},
+		{"PUT", http.StatusInternalServerError, 2},
+		{"GET", http.StatusBadGateway, 2},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %d", test.method, test.status), func(t *testing.T) {
+			attempts := 0
+			sysdig := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if attempts == 1 {
+					w.Header().Set("Retry-After", "0")
+					http.Error(w, "try again", test.status)
+					return
+				}
+				w.Write([]byte(`{}`))
+			}))
+			defer sysdig.Close()
+			client, err := NewSysdigClient(newTestConfig("", sysdig.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client.do(context.Background(), test.method, client.BaseURL+"/gitSources", nil)
+			if attempts != test.attempts {
+				t.Errorf("attempts = %d, want %d", attempts, test.attempts)
+			}
+		})
+	}
+}